@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/download"
+)
+
+// Config holds every setting of a run. It starts from defaultConfig, a JSON file given with
+// -config replaces the settings it mentions, and flags on the command line override both.
+type Config struct {
+	OutputDir      string   `json:"output_dir"`      // directory to save downloaded PDFs into
+	Concurrency    int      `json:"concurrency"`     // PDFs downloaded in parallel
+	Timeout        Duration `json:"timeout"`         // limit for a whole request, including the body
+	ConnectTimeout Duration `json:"connect_timeout"` // limit for establishing a connection
+	HeaderTimeout  Duration `json:"header_timeout"`  // limit for the response headers to arrive
+	RunTimeout     Duration `json:"run_timeout"`     // limit for the whole run; 0 means none
+	UserAgent      string   `json:"user_agent"`      // User-Agent header sent with every request
+	DryRun         bool     `json:"dry_run"`         // list the links and file names without downloading
+	PrintLinks     bool     `json:"print_links"`     // write the bare links to stdout without downloading
+	Diff           bool     `json:"-"`               // compare the two manifests named as arguments instead of running
+	URLs           []string `json:"urls"`            // listing pages to scan
+	URLsFile       string   `json:"urls_file"`       // file with more listing pages, one per line
+	InputFile      string   `json:"input_file"`      // saved listing HTML to take the links from instead of crawling
+	BaseURL        string   `json:"base_url"`        // URL relative links in InputFile are resolved against
+	MaxPages       int      `json:"max_pages"`       // pagination pages followed per listing
+	Depth          int      `json:"depth"`           // same-host links followed away from the listings
+	IgnoreRobots   bool     `json:"ignore_robots"`   // skip the robots.txt checks
+	Rate           float64  `json:"rate"`            // requests per second to each host
+	Jitter         Duration `json:"jitter"`          // longest random delay added before each request
+	Retries        int      `json:"retries"`         // retries of a failed request or interrupted download
+	MaxBandwidth   int64    `json:"max_bandwidth"`   // download bytes per second shared by all downloads
+	PerHost        int      `json:"per_host"`        // concurrent downloads from each host
+	LogLevel       string   `json:"log_level"`       // minimum level to log
+	LogJSON        bool     `json:"log_json"`        // log as JSON lines
+	Report         string   `json:"report"`          // path of the CSV report; empty disables it
+	SummaryFormat  string   `json:"summary_format"`  // text or json summary written to stdout at the end
+	CacheTTL       Duration `json:"cache_ttl"`       // how long cached listing pages are reused
+	Checksums      bool     `json:"checksums"`       // write and verify .sha256 sidecars
+	Verify         bool     `json:"verify"`          // check the saved files against their sidecars instead of downloading
+	HashWorkers    int      `json:"hash_workers"`    // files hashed at the same time by -verify
+	ValidatePDF    bool     `json:"validate_pdf"`    // open each PDF and reject those that don't parse
+	ExtractZips    bool     `json:"extract_zips"`    // also download .zip links and unpack the PDFs inside
+	MaxSize        int64    `json:"max_size"`        // largest PDF to download in bytes
+	MinSize        int64    `json:"min_size"`        // smallest PDF to keep in bytes
+	MaxFiles       int      `json:"max_files"`       // stop after this many successful downloads
+	Quiet          bool     `json:"quiet"`           // only log progress, not every file
+	QuietSkip      bool     `json:"quiet_skip"`      // don't log progress for files that are already present
+	Proxy          string   `json:"proxy"`           // proxy URL for all requests
+	Resolver       string   `json:"resolver"`        // DNS server to look host names up with; empty uses the system's
+	IPVersion      string   `json:"ip_version"`      // "4" or "6" to connect over that IP version only; empty allows both
+	Cookies        string   `json:"cookies"`         // Netscape format cookies file loaded before and saved after the run
+	Include        string   `json:"include"`         // only download URLs matching this expression
+	Exclude        string   `json:"exclude"`         // never download URLs matching this expression
+	Pattern        string   `json:"pattern"`         // links to download instead of PDFs
+	Sort           bool     `json:"sort"`            // process and report links in sorted order
+	HashNames      bool     `json:"hash_names"`      // add a short URL hash to file names
+	Strict         bool     `json:"strict"`          // stop at the first failed download
+	FailOnEmpty    bool     `json:"fail_on_empty"`   // exit with an error when no links are extracted
+	Since          string   `json:"since"`           // only download files modified since this date
+	Refresh        bool     `json:"refresh"`         // revalidate existing files instead of skipping them
+	Force          bool     `json:"force"`           // download and overwrite existing files
+	IgnoreIndex    bool     `json:"ignore_index"`    // download URLs an earlier run recorded in the index
+	Resume         bool     `json:"resume"`          // skip the links an interrupted batch already finished
+	Layout         string   `json:"layout"`          // flat, or shard files into hash or host subdirectories
+	Sink           string   `json:"sink"`            // s3://bucket/prefix or a directory that also receives every file
+	S3Endpoint     string   `json:"s3_endpoint"`     // host or URL of the S3 compatible service
+	S3Region       string   `json:"s3_region"`       // bucket region; empty asks the service
+	BasicAuth      string   `json:"basic_auth"`      // user:pass sent with HTTP basic authentication
+	BearerToken    string   `json:"bearer_token"`    // token sent as an Authorization: Bearer header
+	AuthHosts      []string `json:"auth_hosts"`      // hosts the credentials are sent to besides those of the listings
+	Headers        []string `json:"headers"`         // extra "Name: value" headers sent with every request
+	PostCommand    string   `json:"post_command"`    // command run on every saved file, with its path appended
+	FlattenNames   bool     `json:"flatten_names"`   // name files after the last URL segment when unambiguous
+	LinksCache     string   `json:"links_cache"`     // JSON file the extracted links are cached in; empty disables it
+	RefreshLinks   bool     `json:"refresh_links"`   // extract the links again even when the cache is fresh
+	Preflight      bool     `json:"preflight"`       // total up the batch with HEAD requests before downloading
+	SlowThreshold  Duration `json:"slow_threshold"`  // warn about downloads taking longer than this
+}
+
+// defaultConfig returns the settings used when neither a config file nor a flag says otherwise.
+func defaultConfig() Config {
+	return Config{
+		OutputDir:      "PDFs/",
+		Concurrency:    defaultConcurrency,
+		Timeout:        Duration(5 * time.Minute),
+		ConnectTimeout: Duration(10 * time.Second),
+		HeaderTimeout:  Duration(30 * time.Second),
+		UserAgent:      download.DefaultUserAgent,
+		BaseURL:        defaultSeedURL,
+		MaxPages:       50,
+		Rate:           2,
+		Retries:        defaultMaxAttempts - 1,
+		PerHost:        2,
+		LogLevel:       "info",
+		Report:         "report.csv",
+		SummaryFormat:  summaryText,
+		CacheTTL:       Duration(24 * time.Hour),
+		Layout:         download.LayoutFlat,
+		S3Endpoint:     "s3.amazonaws.com",
+		HashWorkers:    runtime.NumCPU(),
+	}
+}
+
+// registerFlags defines a flag for every setting in config on flags.
+func (config *Config) registerFlags(flags *flag.FlagSet) {
+	// Directory to store downloaded PDFs; -output is kept as a short alias.
+	flags.StringVar(&config.OutputDir, "output-dir", config.OutputDir, "directory to save downloaded PDFs into")
+	flags.StringVar(&config.OutputDir, "output", config.OutputDir, "alias for -output-dir")
+	// Number of PDFs to download at the same time.
+	flags.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "number of PDFs to download in parallel")
+	// Timeouts for the shared HTTP client.
+	flags.Var(&config.Timeout, "timeout", "maximum time for a whole request, including reading the body (0 disables)")
+	flags.Var(&config.ConnectTimeout, "connect-timeout", "maximum time to establish a connection")
+	flags.Var(&config.HeaderTimeout, "header-timeout", "maximum time to wait for response headers once the request is sent")
+	// A hard bound on the whole run, so a scheduled job can't hang.
+	flags.Var(&config.RunTimeout, "run-timeout", "maximum time for the whole run, including the grace period the downloads in flight get to finish; the remaining downloads are abandoned and the summary of what completed is printed (0 disables)")
+	// User-Agent sent with every request.
+	flags.StringVar(&config.UserAgent, "user-agent", config.UserAgent, "User-Agent header sent with every request")
+	// List what would be downloaded without downloading anything.
+	flags.BoolVar(&config.DryRun, "dry-run", config.DryRun, "print the PDF links and their file names without downloading them")
+	flags.BoolVar(&config.Preflight, "preflight", config.Preflight, "send a HEAD request for every link and print the total size of the batch to stderr before downloading (or before the -dry-run listing)")
+	flags.BoolVar(&config.PrintLinks, "print-links", config.PrintLinks, "write each PDF link on its own line to stdout and exit without downloading")
+	// Compare two runs instead of starting a new one.
+	flags.BoolVar(&config.Diff, "diff", config.Diff, "compare two manifests, as in -diff old.json new.json, and print the URLs added, removed and with changed content instead of downloading")
+	// Listing pages to scan for PDF links.
+	flags.Var((*stringList)(&config.URLs), "url", "listing page to scan for PDF links (repeatable, default "+defaultSeedURL+")")
+	flags.StringVar(&config.URLsFile, "urls-file", config.URLsFile, "file with one listing page URL per line")
+	// Work offline from a listing saved in a browser.
+	flags.StringVar(&config.InputFile, "input-file", config.InputFile, "local HTML file to extract the links from instead of fetching the listing pages")
+	flags.StringVar(&config.BaseURL, "base-url", config.BaseURL, "URL the relative links in -input-file are resolved against")
+	// Upper bound on the pages followed through each listing's pagination.
+	flags.IntVar(&config.MaxPages, "max-pages", config.MaxPages, "maximum number of pages to follow per listing")
+	flags.IntVar(&config.Depth, "depth", config.Depth, "also scan same-host pages linked from the listings, up to this many links deep (0 scans the listings only)")
+	// Skip the robots.txt checks when crawling with explicit permission.
+	flags.BoolVar(&config.IgnoreRobots, "ignore-robots", config.IgnoreRobots, "fetch pages and PDFs even if robots.txt disallows them")
+	// Politeness towards each host.
+	flags.Float64Var(&config.Rate, "rate", config.Rate, "maximum requests per second to each host (0 disables the limit)")
+	flags.Var(&config.Jitter, "jitter", "add a random delay of up to this long before each request, such as 500ms, so the traffic looks less regular (0 disables)")
+	flags.IntVar(&config.Retries, "retries", config.Retries, "how many times to retry a failed request or interrupted download")
+	flags.Int64Var(&config.MaxBandwidth, "max-bandwidth", config.MaxBandwidth, "maximum download speed in bytes per second, shared by all downloads (0 disables the limit)")
+	flags.IntVar(&config.PerHost, "per-host", config.PerHost, "maximum concurrent downloads from each host, on top of -concurrency (0 disables the cap)")
+	// Logging verbosity and format.
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "minimum level to log: debug, info, warn or error")
+	flags.BoolVar(&config.LogJSON, "log-json", config.LogJSON, "log as JSON lines instead of text")
+	// CSV report of every processed link.
+	flags.StringVar(&config.Report, "report", config.Report, "path of the CSV report of every processed link (empty disables)")
+	// The summary on stdout, for people or for the scripts that run the scraper.
+	flags.StringVar(&config.SummaryFormat, "summary-format", config.SummaryFormat, "format of the run summary written to stdout: text, or json for a single object with the counts, bytes, elapsed time and status codes")
+	// How long a cached listing page is reused before fetching it again.
+	flags.Var(&config.CacheTTL, "cache-ttl", "refetch cached listing pages older than this (0 always refetches)")
+	// Skip the crawl altogether when an earlier run's links are still fresh.
+	flags.StringVar(&config.LinksCache, "links-cache", config.LinksCache, "JSON file to save the extracted links in and reuse while younger than -cache-ttl, such as links.json (empty disables)")
+	flags.BoolVar(&config.RefreshLinks, "refresh-links", config.RefreshLinks, "extract the links again even when the -links-cache file is fresh")
+	// Point out the downloads that drag a run out.
+	flags.Var(&config.SlowThreshold, "slow-threshold", "warn about each download that takes longer than this, such as 10s (0 disables)")
+	// Integrity checks for the files on disk.
+	flags.BoolVar(&config.ExtractZips, "extract-zips", config.ExtractZips, "also download the .zip archives the listings link to and extract the PDFs inside them next to the archive (at most 1 GiB per archive)")
+	flags.BoolVar(&config.ValidatePDF, "validate-pdf", config.ValidatePDF, "open each downloaded PDF, record its page count in the manifest and reject files that don't parse")
+	flags.BoolVar(&config.Checksums, "checksums", config.Checksums, "write a .sha256 file next to each PDF and re-download existing PDFs that no longer match it")
+	flags.BoolVar(&config.Verify, "verify", config.Verify, "check every file in the output directory that has a .sha256 file against it, report those that no longer match and exit with status 4 if any don't, instead of downloading")
+	flags.IntVar(&config.HashWorkers, "hash-workers", config.HashWorkers, "number of files -verify reads and hashes at the same time")
+	// Size limits for a single PDF.
+	flags.Int64Var(&config.MaxSize, "max-size", config.MaxSize, "skip PDFs larger than this many bytes (0 disables the limit)")
+	flags.Int64Var(&config.MinSize, "min-size", config.MinSize, "reject PDFs smaller than this many bytes as placeholders")
+	// Grab only a handful of documents, e.g. to smoke-test against the live site.
+	flags.IntVar(&config.MaxFiles, "max-files", config.MaxFiles, "stop after this many successful downloads; skipped and failed links don't count (0 disables the cap)")
+	// Only show the running progress rather than a line per downloaded file.
+	flags.BoolVar(&config.Quiet, "quiet", config.Quiet, "suppress per-file download logs and only show progress")
+	flags.BoolVar(&config.QuietSkip, "quiet-skip", config.QuietSkip, "don't log a progress line for files that are already present, so re-runs only show new and failed downloads (they still log at -log-level debug)")
+	// Proxy for all requests; the environment is used when unset.
+	flags.StringVar(&config.Proxy, "proxy", config.Proxy, "proxy URL for all requests (default from HTTP_PROXY/HTTPS_PROXY)")
+	// Name resolution and IP version, for networks where the system defaults misbehave.
+	flags.StringVar(&config.Resolver, "resolver", config.Resolver, "DNS server to resolve host names with, such as 1.1.1.1 or 9.9.9.9:53 (default the system resolver)")
+	flags.StringVar(&config.IPVersion, "ip-version", config.IPVersion, "connect over IPv4 only (4) or IPv6 only (6) (default either)")
+	// Keep session cookies across runs, or start from ones exported from a browser.
+	flags.StringVar(&config.Cookies, "cookies", config.Cookies, "Netscape format cookies file (as written by curl or a browser extension) to load before the run and save the session cookies to afterwards")
+	// Narrow the extracted links down to the documents of interest.
+	flags.StringVar(&config.Include, "include", config.Include, "only download URLs matching this regular expression")
+	flags.StringVar(&config.Exclude, "exclude", config.Exclude, "never download URLs matching this regular expression")
+	flags.StringVar(&config.Pattern, "pattern", config.Pattern, "regular expression matching the absolute links to download instead of PDFs, such as (?i)\\.(pdf|xlsx)$; relaxes the PDF content checks")
+	// Deterministic ordering for reproducible output.
+	flags.BoolVar(&config.Sort, "sort", config.Sort, "process links and write reports in sorted URL order instead of discovery order")
+	// How files are named and which ones are fetched again.
+	flags.BoolVar(&config.HashNames, "hash-names", config.HashNames, "append a short hash of the URL to each file name, including names taken from the response, so distinct URLs never share a file (off by default, since it renames the files already saved)")
+	flags.BoolVar(&config.FlattenNames, "flatten-names", config.FlattenNames, "name files after the last segment of their URL (.../sds/Product-X.pdf saves as product-x.pdf), keeping the full name for URLs whose last segments collide")
+	flags.BoolVar(&config.Strict, "strict", config.Strict, "stop downloading at the first failed PDF instead of carrying on")
+	flags.BoolVar(&config.FailOnEmpty, "fail-on-empty", config.FailOnEmpty, "exit with status 3 when the listings load but no links are extracted from them, as happens when the site's markup changes")
+	flags.StringVar(&config.Since, "since", config.Since, "only download files last modified on or after this date (YYYY-MM-DD or RFC 3339), checked with a HEAD request")
+	flags.BoolVar(&config.Refresh, "refresh", config.Refresh, "re-request existing PDFs with If-Modified-Since and replace those the server has updated")
+	flags.BoolVar(&config.Resume, "resume", config.Resume, "continue the batch checkpointed in the output directory's "+stateFileName+", skipping links it finished and retrying failed and pending ones")
+	flags.BoolVar(&config.IgnoreIndex, "ignore-index", config.IgnoreIndex, "download URLs listed in the output directory's "+download.IndexFileName+" again when their files are missing")
+	flags.BoolVar(&config.Force, "force", config.Force, "download existing PDFs again and overwrite them instead of skipping them")
+	// Spread large crawls over subdirectories.
+	flags.StringVar(&config.Layout, "layout", config.Layout, "output layout: flat, hash (subdirectories by the first two hex characters of the URL hash) or host")
+	// Publish the files beyond the output directory; S3 credentials come from the environment.
+	flags.StringVar(&config.Sink, "sink", config.Sink, "also store every saved file in s3://bucket/prefix or in this directory")
+	flags.StringVar(&config.S3Endpoint, "s3-endpoint", config.S3Endpoint, "S3 compatible endpoint for an s3:// sink, such as http://localhost:9000 for MinIO")
+	flags.StringVar(&config.S3Region, "s3-region", config.S3Region, "region of the s3:// sink's bucket; empty looks it up")
+	// Credentials for gated document libraries; they are sent with every request but never logged.
+	flags.StringVar(&config.BasicAuth, "basic-auth", config.BasicAuth, "user:pass for HTTP basic authentication")
+	flags.StringVar(&config.BearerToken, "bearer-token", config.BearerToken, "token to send in an Authorization: Bearer header")
+	flags.Var((*stringList)(&config.AuthHosts), "auth-host", "host to send the -basic-auth or -bearer-token credentials to, besides the hosts of the listing pages (repeatable); every other host never sees them")
+	flags.Var((*stringList)(&config.Headers), "header", "extra request header as \"Name: value\", such as \"Referer: https://ipcol.com/safety-data-sheets\" for hotlink protected CDNs (repeatable; values are never logged)")
+	// Hand each new file to a processing pipeline.
+	flags.StringVar(&config.PostCommand, "post-command", config.PostCommand, "command to run after each successful download, with the file path appended as the last argument (split on spaces, no shell); failures are logged")
+}
+
+// errInvalidFlags wraps the errors of the command line itself, which the flag set has already
+// reported along with the usage.
+var errInvalidFlags = errors.New("invalid command line")
+
+// parseConfig builds the settings for a run from args: the defaults, then the file named by
+// -config, if any, then the flags given in args.
+func parseConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	config := defaultConfig()
+	var configPath string
+	flags.StringVar(&configPath, "config", "", "JSON file with settings; flags given on the command line override it")
+	config.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return config, fmt.Errorf("%w: %w", errInvalidFlags, err)
+	}
+	if configPath == "" {
+		return config, nil
+	}
+	// The file only knows about the settings it mentions, so start over from the defaults,
+	// apply the file and then parse the flags again so they win.
+	config = defaultConfig()
+	if err := loadConfigFile(configPath, &config); err != nil {
+		return config, err
+	}
+	// A repeatable flag on the command line replaces the file's list instead of adding to it.
+	flags.Visit(func(set *flag.Flag) {
+		if list, ok := set.Value.(*stringList); ok {
+			*list = nil
+		}
+	})
+	if err := flags.Parse(args); err != nil {
+		return config, fmt.Errorf("%w: %w", errInvalidFlags, err)
+	}
+	return config, nil
+}
+
+// loadConfigFile reads the JSON file at path into config. Settings the file doesn't mention
+// keep their current value; unknown keys are rejected so a typo doesn't go unnoticed.
+func loadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// stringList is a flag.Value that collects every occurrence of a repeatable flag.
+type stringList []string
+
+// String returns the collected values separated by commas.
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+// Set appends another value.
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// Duration is a time.Duration that is written as a string such as "30s" or "5m", both in
+// JSON and on the command line.
+type Duration time.Duration
+
+// String formats the duration like time.Duration does.
+func (duration *Duration) String() string {
+	return time.Duration(*duration).String()
+}
+
+// Set parses a flag value such as "30s".
+func (duration *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// UnmarshalJSON reads a duration string such as "24h".
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	return duration.Set(value)
+}
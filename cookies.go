@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/fsutil"
+	"golang.org/x/net/publicsuffix"
+)
+
+// httpOnlyPrefix marks HttpOnly cookies in a Netscape cookies file, as curl and browsers write them.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// cookieStore is the cookie jar shared by every request, so a session cookie set while
+// fetching a listing page is sent along with the PDF downloads. Unlike a bare
+// cookiejar.Jar it remembers every cookie it was given, so they can be saved to a Netscape
+// format cookies file and loaded again by the next run. It is safe for concurrent use.
+type cookieStore struct {
+	jar     *cookiejar.Jar
+	mutex   sync.Mutex
+	cookies map[string]savedCookie // keyed by domain, path and name
+}
+
+// savedCookie is one line of a Netscape cookies file.
+type savedCookie struct {
+	domain     string // host the cookie belongs to, with a leading dot when subdomains get it too
+	subdomains bool
+	path       string
+	secure     bool
+	httpOnly   bool
+	expires    time.Time // zero for a session cookie
+	name       string
+	value      string
+}
+
+// newCookieStore returns an empty cookie store.
+func newCookieStore() *cookieStore {
+	// The public suffix list stops a site from setting cookies for all of .com.
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &cookieStore{jar: jar, cookies: make(map[string]savedCookie)}
+}
+
+// SetCookies hands the cookies to the jar and remembers them for saving.
+func (store *cookieStore) SetCookies(target *url.URL, cookies []*http.Cookie) {
+	store.jar.SetCookies(target, cookies)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, cookie := range cookies {
+		saved := savedCookie{
+			domain:   target.Hostname(),
+			path:     cookie.Path,
+			secure:   cookie.Secure,
+			httpOnly: cookie.HttpOnly,
+			expires:  cookie.Expires,
+			name:     cookie.Name,
+			value:    cookie.Value,
+		}
+		// Without a Domain attribute the cookie only goes back to the host that set it.
+		if cookie.Domain != "" {
+			saved.domain = "." + strings.TrimPrefix(cookie.Domain, ".")
+			saved.subdomains = true
+		}
+		if saved.path == "" || !strings.HasPrefix(saved.path, "/") {
+			saved.path = "/"
+		}
+		if cookie.MaxAge > 0 {
+			saved.expires = time.Now().Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+		key := saved.domain + "\t" + saved.path + "\t" + saved.name
+		// A cookie that has already expired is the server deleting it.
+		if cookie.MaxAge < 0 || (!saved.expires.IsZero() && saved.expires.Before(time.Now())) {
+			delete(store.cookies, key)
+			continue
+		}
+		store.cookies[key] = saved
+	}
+}
+
+// Cookies returns the cookies to send with a request to target.
+func (store *cookieStore) Cookies(target *url.URL) []*http.Cookie {
+	return store.jar.Cookies(target)
+}
+
+// load adds the cookies in the Netscape format file at path. A missing file adds nothing,
+// so the first run with -cookies starts with an empty jar and creates the file.
+func (store *cookieStore) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read cookies %s: %w", path, err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(text, httpOnlyPrefix)
+		text = strings.TrimPrefix(text, httpOnlyPrefix)
+		// Skip blank lines and comments such as the "# Netscape HTTP Cookie File" header.
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("read cookies %s: line %d: expected 7 tab separated fields, got %d", path, line, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("read cookies %s: line %d: invalid expiry %q", path, line, fields[4])
+		}
+		cookie := &http.Cookie{
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = fields[0]
+		}
+		// Hand the cookie over as if the host it belongs to had just set it.
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		store.SetCookies(&url.URL{Scheme: scheme, Host: strings.TrimPrefix(fields[0], "."), Path: "/"}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read cookies %s: %w", path, err)
+	}
+	return nil
+}
+
+// save writes every cookie still in force to path in Netscape format, sorted so the file
+// only changes when the cookies do.
+func (store *cookieStore) save(path string) error {
+	store.mutex.Lock()
+	var lines []string
+	for _, cookie := range store.cookies {
+		if !cookie.expires.IsZero() && cookie.expires.Before(time.Now()) {
+			continue
+		}
+		expiry := int64(0)
+		if !cookie.expires.IsZero() {
+			expiry = cookie.expires.Unix()
+		}
+		line := strings.Join([]string{
+			cookie.domain,
+			strings.ToUpper(strconv.FormatBool(cookie.subdomains)),
+			cookie.path,
+			strings.ToUpper(strconv.FormatBool(cookie.secure)),
+			strconv.FormatInt(expiry, 10),
+			cookie.name,
+			cookie.value,
+		}, "\t")
+		if cookie.httpOnly {
+			line = httpOnlyPrefix + line
+		}
+		lines = append(lines, line)
+	}
+	store.mutex.Unlock()
+	slices.Sort(lines)
+	content := "# Netscape HTTP Cookie File\n\n" + strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := fsutil.WriteFileAtomic(path, []byte(content)); err != nil {
+		return fmt.Errorf("write cookies: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/download"
+)
+
+// manifestDiff is what changed between two manifests.
+type manifestDiff struct {
+	added   []download.Record // in the new manifest only
+	removed []download.Record // in the old manifest only
+	changed []manifestChange  // in both, with different content
+}
+
+// manifestChange is a URL whose content hash differs between two manifests.
+type manifestChange struct {
+	old, new download.Record
+}
+
+// readManifest loads the records of a manifest written by download.WriteManifest.
+func readManifest(path string) ([]download.Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	var records []download.Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// diffManifests compares two manifests by URL, with every list sorted by URL. A URL listed
+// more than once counts with its last record.
+func diffManifests(oldRecords, newRecords []download.Record) manifestDiff {
+	byURL := func(records []download.Record) map[string]download.Record {
+		indexed := make(map[string]download.Record, len(records))
+		for _, record := range records {
+			indexed[record.URL] = record
+		}
+		return indexed
+	}
+	before, after := byURL(oldRecords), byURL(newRecords)
+	var diff manifestDiff
+	for uri, record := range after {
+		previous, ok := before[uri]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, record)
+		case previous.SHA256 != record.SHA256:
+			diff.changed = append(diff.changed, manifestChange{old: previous, new: record})
+		}
+	}
+	for uri, record := range before {
+		if _, ok := after[uri]; !ok {
+			diff.removed = append(diff.removed, record)
+		}
+	}
+	compareURLs := func(a, b download.Record) int {
+		return cmp.Compare(a.URL, b.URL)
+	}
+	slices.SortFunc(diff.added, compareURLs)
+	slices.SortFunc(diff.removed, compareURLs)
+	slices.SortFunc(diff.changed, func(a, b manifestChange) int {
+		return compareURLs(a.new, b.new)
+	})
+	return diff
+}
+
+// writeText prints the added, removed and changed URLs, one per line, each section only
+// when it has any.
+func (diff manifestDiff) writeText(writer io.Writer) {
+	if len(diff.added) > 0 {
+		fmt.Fprintf(writer, "added (%d):\n", len(diff.added))
+		for _, record := range diff.added {
+			fmt.Fprintf(writer, "  + %s\n", record.URL)
+		}
+	}
+	if len(diff.removed) > 0 {
+		fmt.Fprintf(writer, "removed (%d):\n", len(diff.removed))
+		for _, record := range diff.removed {
+			fmt.Fprintf(writer, "  - %s\n", record.URL)
+		}
+	}
+	if len(diff.changed) > 0 {
+		fmt.Fprintf(writer, "changed (%d):\n", len(diff.changed))
+		for _, change := range diff.changed {
+			fmt.Fprintf(writer, "  ~ %s (%s → %s)\n", change.new.URL, shortHash(change.old.SHA256), shortHash(change.new.SHA256))
+		}
+	}
+	if len(diff.added)+len(diff.removed)+len(diff.changed) == 0 {
+		fmt.Fprintln(writer, "no differences")
+	}
+}
+
+// shortHash abbreviates a hex encoded hash to its first 12 characters, like git does.
+func shortHash(hash string) string {
+	return hash[:min(len(hash), 12)]
+}
+
+// runDiff compares the manifests at oldPath and newPath and prints what changed.
+func runDiff(writer io.Writer, oldPath, newPath string) error {
+	oldRecords, err := readManifest(oldPath)
+	if err != nil {
+		return err
+	}
+	newRecords, err := readManifest(newPath)
+	if err != nil {
+		return err
+	}
+	diffManifests(oldRecords, newRecords).writeText(writer)
+	return nil
+}
@@ -0,0 +1,123 @@
+package download
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+)
+
+// maxExtractedSize caps the bytes extracted from one archive. A small ZIP can expand to
+// terabytes (a "decompression bomb"), and the sizes in its headers can't be trusted.
+const maxExtractedSize = 1 << 30 // 1 GiB
+
+// errArchiveTooLarge is returned when an archive expands past maxExtractedSize.
+var errArchiveTooLarge = errors.New("archive expands past the size limit")
+
+// errNotPDF is returned for an archive member named like a PDF that doesn't start like one.
+var errNotPDF = errors.New("member does not start with the PDF signature")
+
+// extractZipPDFs extracts every PDF in the ZIP archive at archivePath into dir, under the names
+// chosen by extract.ZipMemberFilename, and returns those names. Members that aren't PDFs or
+// that try to escape dir are skipped, and so are PDFs already in dir unless options.force is
+// set. The extracted files get the checks a downloaded PDF gets: the signature, -validate-pdf
+// and a -checksums sidecar. Extraction stops with errArchiveTooLarge once the PDFs add up to
+// more than limit bytes.
+func (options downloadOptions) extractZipPDFs(archivePath, dir string, limit int64) ([]string, error) {
+	files := options.disk()
+	opened, err := openFile(files, archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open archive %s: %w", archivePath, err)
+	}
+	defer opened.Close()
+	info, err := opened.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("open archive %s: %w", archivePath, err)
+	}
+	archive, err := zip.NewReader(opened, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("open archive %s: %w", archivePath, err)
+	}
+	var extracted []string
+	remaining := limit
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		name, ok := extract.ZipMemberFilename(filepath.Base(archivePath), member.Name)
+		if !ok {
+			slog.Debug("skipping archive member", "archive", archivePath, "member", member.Name)
+			continue
+		}
+		destination := filepath.Join(dir, name)
+		if !options.force && fileStillExists(files, destination) {
+			continue
+		}
+		written, err := options.extractMember(member, destination, remaining)
+		remaining -= written
+		// A bad member is skipped like any other non-PDF rather than failing the whole archive.
+		if errors.Is(err, errNotPDF) || errors.Is(err, errCorruptPDF) {
+			slog.Warn("skipping archive member", "archive", archivePath, "member", member.Name, "error", err)
+			continue
+		}
+		if err != nil {
+			return extracted, fmt.Errorf("extract %s from %s: %w", member.Name, archivePath, err)
+		}
+		extracted = append(extracted, name)
+	}
+	return extracted, nil
+}
+
+// extractMember writes member to destination through a temporary file, so a failure never
+// leaves half a PDF behind, and fails with errArchiveTooLarge past limit bytes. It returns
+// how many bytes it read, even when the member turned out not to be a usable PDF.
+func (options downloadOptions) extractMember(member *zip.File, destination string, limit int64) (int64, error) {
+	files := options.disk()
+	reader, err := member.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	// Only the extension said this is a PDF, so check the bytes before writing anything.
+	body := bufio.NewReader(reader)
+	if head, _ := body.Peek(len(pdfMagic)); !hasPDFHeader(head) {
+		return 0, errNotPDF
+	}
+	tempPath := filepath.Join(filepath.Dir(destination), ".extract-"+filepath.Base(destination))
+	temp, err := createFile(files, tempPath)
+	if err != nil {
+		return 0, err
+	}
+	// Read one byte past the limit to tell a member that fits exactly from one that doesn't.
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(temp, hasher), io.LimitReader(body, limit+1))
+	if err == nil && written > limit {
+		err = errArchiveTooLarge
+	}
+	err = errors.Join(err, temp.Close())
+	if err == nil && options.validatePDF {
+		if _, validateErr := pdfPageCount(files, tempPath); validateErr != nil {
+			err = fmt.Errorf("%w: %w", errCorruptPDF, validateErr)
+		}
+	}
+	if err == nil {
+		err = files.Rename(tempPath, destination)
+	}
+	if err != nil {
+		files.Remove(tempPath)
+		return written, err
+	}
+	if options.checksums {
+		if err := writeChecksumFile(files, destination, hex.EncodeToString(hasher.Sum(nil))); err != nil {
+			slog.Warn("unable to write checksum file", "path", destination, "error", err)
+		}
+	}
+	return written, nil
+}
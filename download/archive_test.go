@@ -0,0 +1,78 @@
+package download
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDownloadPDFExtractsZipArchives(t *testing.T) {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for name, content := range map[string]string{
+		"sds/Product-A.pdf": testPDF + "a",
+		"Product-B.PDF":     testPDF + "b",
+		"readme.txt":        "not a PDF",
+		"fake.pdf":          "<html>not a PDF either</html>",
+		"../../escaped.pdf": testPDF + "evil",
+	} {
+		member, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(member, content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(archive.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.extractZips = true
+	options.checksums = true
+	outputDir := filepath.Join(t.TempDir(), "out")
+	if err := os.Mkdir(outputDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := downloadPDF(context.Background(), options, server.URL+"/bundle.zip", outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	slices.Sort(record.Extracted)
+	stem := strings.TrimSuffix(record.Filename, ".zip")
+	want := []string{stem + "_product-a.pdf", stem + "_product-b.pdf"}
+	if !slices.Equal(record.Extracted, want) {
+		t.Errorf("Extracted = %q, want %q", record.Extracted, want)
+	}
+	// Extracted PDFs get checksums like downloaded ones.
+	for _, name := range want {
+		if matches, err := checksumMatches(osFileSystem{}, filepath.Join(outputDir, name)); err != nil || !matches {
+			t.Errorf("checksum of extracted %s = %v, %v, want a matching sidecar", name, matches, err)
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, name+checksumSuffix)); err != nil {
+			t.Errorf("checksum file of extracted PDF missing: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(outputDir)), "escaped.pdf")); err == nil {
+		t.Error("a member escaped the output directory")
+	}
+
+	// An archive that expands past the limit is refused.
+	_, err = options.extractZipPDFs(filepath.Join(outputDir, record.Filename), t.TempDir(), int64(len(testPDF)))
+	if !errors.Is(err, errArchiveTooLarge) {
+		t.Errorf("extractZipPDFs() past the limit error = %v, want errArchiveTooLarge", err)
+	}
+}
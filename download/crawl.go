@@ -0,0 +1,294 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/fsutil"
+)
+
+// listingCachePath returns the local file a listing page is cached in.
+func listingCachePath(pageURL string) string {
+	return strings.TrimSuffix(extract.URLToFilename(pageURL), ".pdf") + ".html"
+}
+
+// Crawl holds the settings for finding links on the listing pages.
+type Crawl struct {
+	MaxPages    int            // pages of pagination followed per listing
+	MaxDepth    int            // links followed away from a listing to other pages; 0 stays on the listings
+	CacheTTL    time.Duration  // how long a cached listing page is used before fetching it again
+	LinkPattern *regexp.Regexp // links to download; nil means PDFs
+	Fetcher     Fetcher        // loads the pages; nil fetches them over HTTP with the session's settings
+	Concurrency int            // pages scanned at once; below 1 means one at a time
+	Zips        bool           // also collect links to .zip archives, for Options.ExtractZips
+	Claimed     *URLSet        // links already handed to a download, as in Options.Claimed, which are left out; nil leaves none out
+}
+
+// links returns the links in a page's HTML that should be downloaded.
+func (crawl Crawl) links(content, pageURL string) []string {
+	var links []string
+	if crawl.LinkPattern == nil {
+		links = extract.PDFLinks(content, pageURL)
+	} else {
+		links = extract.MatchingLinks(content, pageURL, crawl.LinkPattern)
+	}
+	if crawl.Zips {
+		links = append(links, extract.ZipLinks(content, pageURL)...)
+	}
+	return links
+}
+
+// crawlPage is a page waiting to be scanned, with how many links away from a seed it is.
+type crawlPage struct {
+	url   string
+	depth int
+}
+
+// errListingUnavailable is returned by CollectLinks when a listing page could neither be
+// fetched nor read from the cache.
+var errListingUnavailable = errors.New("listing page unavailable")
+
+// CollectLinks fetches every listing page (or reads its cached copy while it is younger
+// than crawl.CacheTTL), follows its pagination for up to crawl.MaxPages pages, and returns the
+// deduplicated document links found. With crawl.MaxDepth above zero it also follows links to
+// other pages on the same host, up to that many links away from a listing. Up to
+// crawl.Concurrency listings and pages are scanned at once, so the order of the links varies
+// between runs. Links in crawl.Claimed were downloaded already and are left out. The links
+// from the listings that did load are returned even when others are unavailable.
+func (session *Session) CollectLinks(ctx context.Context, crawl Crawl, pageURLs []string) ([]string, error) {
+	options := session.options
+	fetcher := crawl.Fetcher
+	if fetcher == nil {
+		fetcher = httpFetcher{options: options}
+	}
+	// The sets compare URLs in canonical form, so trivial variants and links found on more than
+	// one page collapse. Pages are shared between listings and crawled pages so none is fetched
+	// twice and links back to earlier pages can't loop forever.
+	var found, visited URLSet
+	var mutex sync.Mutex
+	var unavailable []string
+	// Every scan runs in its own goroutine, but only while holding one of the slots.
+	slots := make(chan struct{}, max(crawl.Concurrency, 1))
+	var pending sync.WaitGroup
+	var scan func(page crawlPage)
+	scan = func(page crawlPage) {
+		defer pending.Done()
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		next, ok := crawl.walk(ctx, options, fetcher, page, &found, &visited)
+		<-slots
+		// A listing the user asked for is worth reporting; a crawled page is not.
+		if !ok && page.depth == 0 {
+			mutex.Lock()
+			unavailable = append(unavailable, page.url)
+			mutex.Unlock()
+		}
+		for _, link := range next {
+			if !visited.Contains(link) {
+				pending.Add(1)
+				go scan(crawlPage{url: link, depth: page.depth + 1})
+			}
+		}
+	}
+	for _, seedURL := range pageURLs {
+		// Skip anything that isn't a usable URL.
+		if !extract.IsURLValid(seedURL) {
+			slog.Warn("skipping invalid listing URL", "url", seedURL)
+			continue
+		}
+		pending.Add(1)
+		go scan(crawlPage{url: seedURL})
+	}
+	pending.Wait()
+	// A page whose own URL mentions .pdf (say in its query) can link to itself, but it is
+	// HTML rather than a document, so drop links back to any page that was scanned.
+	scanned := make(map[string]bool)
+	for _, pageURL := range visited.Snapshot() {
+		scanned[extract.NormalizeURL(pageURL)] = true
+	}
+	links := slices.DeleteFunc(found.Snapshot(), func(link string) bool {
+		return scanned[extract.NormalizeURL(link)] || (crawl.Claimed != nil && crawl.Claimed.Contains(link))
+	})
+	if len(unavailable) > 0 {
+		slices.Sort(unavailable)
+		return links, fmt.Errorf("%w: %s", errListingUnavailable, strings.Join(unavailable, ", "))
+	}
+	return links, nil
+}
+
+// walk scans page and the pages its pagination leads to, adding the document links to found
+// and every page it claims to visited. It returns the links to other pages worth following
+// while still within the crawl depth, and false when page itself couldn't be loaded.
+func (crawl Crawl) walk(ctx context.Context, options httpOptions, fetcher Fetcher, page crawlPage, found, visited *URLSet) ([]string, bool) {
+	var next []string
+	pageURL := page.url
+	pages := 0
+	// Walk the pages of this listing until there is no next page or another scan has it.
+	for pageURL != "" && visited.Add(pageURL) {
+		if pages >= crawl.MaxPages {
+			slog.Warn("stopping pagination", "url", page.url, "max_pages", crawl.MaxPages)
+			break
+		}
+		pages++
+		// Respect the site's wishes before fetching the page.
+		if !options.robots.allowed(ctx, pageURL) {
+			slog.Info("skipping listing page", "url", pageURL, "reason", errDisallowedByRobots)
+			break
+		}
+		content, ok := loadListingPage(ctx, fetcher, pageURL, crawl.CacheTTL)
+		if !ok {
+			return next, pageURL != page.url
+		}
+		links := crawl.links(content, pageURL)
+		// A listing that has HTML but no documents most likely had its markup changed.
+		if len(links) == 0 && page.depth == 0 && strings.TrimSpace(content) != "" {
+			slog.Warn("no links found on listing page, its markup may have changed", "url", pageURL)
+		}
+		for _, link := range links {
+			found.Add(link)
+		}
+		// Collect the pages this one links to while still within the crawl depth.
+		if page.depth < crawl.MaxDepth {
+			for _, link := range extract.PageLinks(content, pageURL) {
+				next = append(next, link)
+			}
+		}
+		pageURL = extract.NextPageLink(content, pageURL)
+	}
+	return next, true
+}
+
+// loadListingPage returns the HTML of a listing page, fetching it unless a cached copy
+// younger than cacheTTL exists.
+func loadListingPage(ctx context.Context, fetcher Fetcher, pageURL string, cacheTTL time.Duration) (string, bool) {
+	// The local file path where the content will be saved.
+	localFilePath := listingCachePath(pageURL)
+	// Fetch the page unless a fresh copy is already cached. A cache that can't be checked is
+	// fetched again, and the unreadable copy is reported when it is read back below.
+	cached, err := fileExists(osFileSystem{}, localFilePath)
+	if err != nil {
+		slog.Warn("unable to check cached listing page", "path", localFilePath, "error", err)
+	}
+	if !cached || fsutil.FileOlderThan(localFilePath, cacheTTL) {
+		data, err := fetcher.Fetch(ctx, pageURL)
+		// Keep the previous copy, if any, rather than replacing it with nothing.
+		if err != nil {
+			slog.Error("unable to fetch listing page", "error", err)
+		} else if err := fsutil.WriteToFile(localFilePath, data); err != nil {
+			// A failed write may leave a truncated cache that later runs would trust, so drop it
+			// and scan the page just fetched instead of reading the cache back.
+			slog.Error("unable to cache listing page", "url", pageURL, "error", err)
+			os.Remove(localFilePath)
+			return string(data), true
+		}
+	}
+	// If the file exists, return its content.
+	if cached, err := fileExists(osFileSystem{}, localFilePath); !cached {
+		if err != nil {
+			slog.Error("unable to read cached listing page", "path", localFilePath, "error", err)
+		}
+		return "", false
+	}
+	return fsutil.ReadAFileAsString(localFilePath), true
+}
+
+// LinksFromFile returns the deduplicated document links in a saved HTML page, resolving
+// relative links against baseURL.
+func LinksFromFile(crawl Crawl, path, baseURL string) ([]string, error) {
+	exists, err := fileExists(osFileSystem{}, path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	var found URLSet
+	for _, link := range crawl.links(fsutil.ReadAFileAsString(path), baseURL) {
+		found.Add(link)
+	}
+	return found.Snapshot(), nil
+}
+
+// LinkSource describes what a cached link list was extracted from, so a cache built from
+// other listings or crawl settings is never reused.
+type LinkSource struct {
+	Seeds    []string `json:"seeds"`
+	MaxPages int      `json:"max_pages"`
+	Depth    int      `json:"depth"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Zips     bool     `json:"zips,omitempty"`
+}
+
+// Source returns the LinkSource for crawling seedURLs with these settings.
+func (crawl Crawl) Source(seedURLs []string) LinkSource {
+	source := LinkSource{Seeds: seedURLs, MaxPages: crawl.MaxPages, Depth: crawl.MaxDepth, Zips: crawl.Zips}
+	if crawl.LinkPattern != nil {
+		source.Pattern = crawl.LinkPattern.String()
+	}
+	return source
+}
+
+// equal reports whether both sources describe the same crawl.
+func (source LinkSource) equal(other LinkSource) bool {
+	return slices.Equal(source.Seeds, other.Seeds) && source.MaxPages == other.MaxPages &&
+		source.Depth == other.Depth && source.Pattern == other.Pattern && source.Zips == other.Zips
+}
+
+// linksCache is the content of a links cache file.
+type linksCache struct {
+	Source LinkSource `json:"source"`
+	Links  []string   `json:"links"`
+}
+
+// LoadLinksCache returns the links cached in path when the file is younger than ttl and was
+// built from source. It reports false when the links have to be extracted again.
+func LoadLinksCache(path string, source LinkSource, ttl time.Duration) ([]string, bool) {
+	exists, err := fileExists(osFileSystem{}, path)
+	if err != nil {
+		slog.Warn("unable to check links cache", "path", path, "error", err)
+	}
+	if !exists || fsutil.FileOlderThan(path, ttl) {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("unable to read links cache", "path", path, "error", err)
+		return nil, false
+	}
+	var cache linksCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		slog.Warn("ignoring unreadable links cache", "path", path, "error", err)
+		return nil, false
+	}
+	if !cache.Source.equal(source) {
+		slog.Info("links cache is for other listings, extracting again", "path", path)
+		return nil, false
+	}
+	return cache.Links, true
+}
+
+// SaveLinksCache writes links, extracted from source, to path for LoadLinksCache.
+func SaveLinksCache(path string, source LinkSource, links []string) error {
+	// Write an empty list rather than null when nothing was found.
+	if links == nil {
+		links = []string{}
+	}
+	data, err := json.MarshalIndent(linksCache{Source: source, Links: links}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write links cache %s: %w", path, err)
+	}
+	return fsutil.WriteToFile(path, append(data, '\n'))
+}
@@ -0,0 +1,1538 @@
+// Package download fetches documents over HTTP the way a polite crawler should: it honors
+// robots.txt, limits the rate per host, retries and resumes broken transfers, and skips the
+// files a directory already holds. Download saves a batch of links and streams a Result for
+// each one as it finishes; a Session finds the links on listing pages first.
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// HTTPOptions configures a Session. The zero value sends each request once with
+// http.DefaultClient and honors robots.txt.
+type HTTPOptions struct {
+	Client        *http.Client  // shared client used for all requests; nil means http.DefaultClient
+	UserAgent     string        // value of the User-Agent header; empty means DefaultUserAgent
+	Retries       int           // retries of a failed request or interrupted transfer
+	Rate          float64       // requests per second to each host; 0 means unlimited
+	PerHost       int           // requests in flight to each host; 0 means unlimited
+	Jitter        time.Duration // longest random delay added before each request; 0 adds none
+	Authorization string        // value of the Authorization header; empty sends none
+	AuthHosts     []string      // hosts the Authorization header is sent to; no other host sees it
+	Headers       http.Header   // extra headers sent with every request
+	IgnoreRobots  bool          // fetch what robots.txt disallows
+}
+
+// Session sends the requests of a run. The listing pages and the downloads share its client,
+// robots.txt rules, rate limits and credentials, so a run uses a single Session. It is safe
+// for concurrent use.
+type Session struct {
+	options httpOptions
+}
+
+// NewSession returns a Session sending requests as options describes.
+func NewSession(options HTTPOptions) *Session {
+	client := options.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	userAgent := options.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	authHosts := make(map[string]bool)
+	for _, host := range options.AuthHosts {
+		authHosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	session := &Session{options: httpOptions{
+		client:        client,
+		userAgent:     userAgent,
+		maxAttempts:   max(options.Retries, 0) + 1,
+		limiter:       newHostRateLimiter(options.Rate),
+		jitter:        options.Jitter,
+		hostSlots:     newHostSemaphore(options.PerHost),
+		authorization: options.Authorization,
+		authHosts:     authHosts,
+		headers:       options.Headers,
+	}}
+	if !options.IgnoreRobots {
+		session.options.robots = newRobotsChecker(session.options)
+	}
+	return session
+}
+
+// Options configures Download. The zero value downloads PDFs one at a time with a new
+// Session into dir itself, skipping the files already there.
+type Options struct {
+	Session       *Session          // sends the requests; nil uses NewSession(HTTPOptions{})
+	Concurrency   int               // downloads run at once; below 1 means one at a time
+	Checksums     bool              // write .sha256 sidecars and verify existing files against them
+	MaxSize       int64             // largest file to download in bytes; 0 means no limit
+	MinSize       int64             // smallest file to keep in bytes; smaller ones are placeholders
+	MaxBandwidth  int64             // download bytes per second shared by all downloads; 0 means unlimited
+	Quiet         bool              // log each saved file at debug rather than info level
+	Refresh       bool              // revalidate existing files with If-Modified-Since instead of skipping them
+	Force         bool              // download and overwrite existing files instead of skipping them
+	HashNames     bool              // add a short hash of the URL to file names so distinct URLs never collide
+	Strict        bool              // abort the remaining downloads after the first failure
+	AnyDocument   bool              // accept documents other than PDFs
+	Since         time.Time         // skip files the server says were last modified before this; zero disables
+	Layout        string            // how files are spread over subdirectories of dir; empty means LayoutFlat
+	Sink          Sink              // also receives every saved file; nil keeps them only in dir
+	PostCommand   []string          // program and arguments run with each saved file's path appended; empty runs nothing
+	FlatNames     map[string]string // URL to the bare file name it is saved under, as returned by FlatNames
+	SlowThreshold time.Duration     // warn about downloads taking longer than this; 0 disables the warning
+	Index         *Index            // URLs downloaded by any earlier run into dir; nil keeps no record
+	IgnoreIndex   bool              // download URLs the index already lists, as long as their files are gone
+	ValidatePDF   bool              // open every PDF and count its pages, rejecting those that don't parse
+	MaxFiles      int               // stop once this many files were downloaded; skips don't count; 0 means no cap
+	ExtractZips   bool              // download .zip links and unpack the PDFs inside them
+	Grace         time.Duration     // how long downloads in flight may finish once ctx is cancelled; 0 aborts them
+	Claimed       *URLSet           // links handed to a download so far, which are skipped; share it with Crawl.Claimed; nil gives each Download its own
+}
+
+// settings returns the downloadOptions for a single Download with options.
+func (options Options) settings() downloadOptions {
+	session := options.Session
+	if session == nil {
+		session = NewSession(HTTPOptions{})
+	}
+	claimed := options.Claimed
+	if claimed == nil {
+		claimed = &URLSet{}
+	}
+	return downloadOptions{
+		httpOptions:   session.options,
+		contentHashes: newContentIndex(),
+		checksums:     options.Checksums,
+		maxSize:       options.MaxSize,
+		minSize:       options.MinSize,
+		quiet:         options.Quiet,
+		refresh:       options.Refresh,
+		force:         options.Force,
+		hashNames:     options.HashNames,
+		strict:        options.Strict,
+		bandwidth:     newBandwidthLimiter(options.MaxBandwidth),
+		anyDocument:   options.AnyDocument,
+		since:         options.Since,
+		layout:        options.Layout,
+		sink:          options.Sink,
+		postCommand:   options.PostCommand,
+		flatNames:     options.FlatNames,
+		claimed:       claimed,
+		slowThreshold: options.SlowThreshold,
+		index:         options.Index,
+		ignoreIndex:   options.IgnoreIndex,
+		validatePDF:   options.ValidatePDF,
+		maxFiles:      options.MaxFiles,
+		extractZips:   options.ExtractZips,
+		grace:         options.Grace,
+		inFlight:      &singleflight.Group{},
+	}
+}
+
+// naming returns just the downloadOptions that decide where a document is saved, without the
+// state settings sets up for a download.
+func (options Options) naming() downloadOptions {
+	return downloadOptions{
+		hashNames:   options.HashNames,
+		anyDocument: options.AnyDocument,
+		layout:      options.Layout,
+		flatNames:   options.FlatNames,
+		extractZips: options.ExtractZips,
+	}
+}
+
+// Path returns where in the download directory the document at link is saved, such as
+// "ab/sds_a.pdf" with LayoutHash.
+func (options Options) Path(link string) string {
+	naming := options.naming()
+	return filepath.Join(naming.shardFor(link), naming.filenameFor(link))
+}
+
+// Collisions maps every file name, relative to the download directory, that more than one of
+// the links would be saved under to those links. Only the first link to reach such a file gets
+// downloaded; the others are skipped as already present.
+func (options Options) Collisions(links []string) map[string][]string {
+	return filenameCollisions(options.naming(), links)
+}
+
+// Download downloads every link into dir, options.Concurrency at a time, and returns at once.
+// The Result of each link is sent on the returned channel as soon as it is known; the channel
+// is closed when all links have been processed or ctx is cancelled. The caller must drain it.
+func Download(ctx context.Context, links []string, dir string, options Options) <-chan Result {
+	return downloadStream(ctx, options.settings(), links, dir, options.Concurrency)
+}
+
+// retryBaseDelay is the wait before the first retry; it doubles on every further attempt.
+var retryBaseDelay = time.Second
+
+// ErrAlreadyExists is returned by downloadPDF when the destination file is already on disk.
+var ErrAlreadyExists = errors.New("file already exists")
+
+// errDuplicateURL is returned by the worker pool for a link that was already claimed in this run.
+var errDuplicateURL = errors.New("URL already handled in this run")
+
+// errNoFilename is returned by downloadPDF when no file name can be derived from a URL.
+var errNoFilename = errors.New("unable to derive a file name from the URL")
+
+// errCorruptPDF is returned by downloadPDF when -validate-pdf can't open a downloaded PDF.
+var errCorruptPDF = errors.New("PDF does not open")
+
+// ErrSoft404 is returned by downloadPDF when a server answers 200 OK with an HTML error page
+// instead of the document, which usually means the document is missing.
+var ErrSoft404 = errors.New("HTML error page instead of the document (soft 404)")
+
+// errTooOld is returned by downloadPDF when a file was last modified before the -since cutoff.
+var errTooOld = errors.New("not modified since the cutoff")
+
+// errTooLarge is returned by downloadPDF when a file exceeds the configured maximum size.
+var errTooLarge = errors.New("file exceeds the maximum size")
+
+// IsSkip reports whether err means a link was deliberately skipped rather than failed.
+func IsSkip(err error) bool {
+	return errors.Is(err, ErrAlreadyExists) ||
+		errors.Is(err, errDuplicateURL) ||
+		errors.Is(err, errDisallowedByRobots) ||
+		errors.Is(err, errTooLarge) ||
+		errors.Is(err, errTooOld)
+}
+
+// Result is the outcome of downloading a single link.
+type Result struct {
+	URL     string        // the link as given to Download
+	Path    string        // where the document is on disk; empty unless it was saved or already present
+	Bytes   int64         // size of the saved document; 0 unless it was saved by this download
+	Err     error         // why the download failed or was skipped; nil when the document was saved
+	Record  Record        // details of the download; filled in as far as it got when Err is set
+	Elapsed time.Duration // wall time of the download, retries included
+}
+
+// newResult returns the Result of downloading link into outputDir.
+func newResult(link, outputDir string, record Record, err error, elapsed time.Duration) Result {
+	record.URL = link
+	result := Result{URL: link, Err: err, Record: record, Elapsed: elapsed}
+	if record.Filename != "" && (err == nil || errors.Is(err, ErrAlreadyExists)) {
+		result.Path = filepath.Join(outputDir, filepath.FromSlash(record.Filename))
+	}
+	if err == nil {
+		result.Bytes = record.Size
+	}
+	return result
+}
+
+// downloadStream downloads every link into outputDir using a bounded pool of goroutines and
+// returns at once. The result of each processed link is sent on the returned channel as soon
+// as it is known, for callers that want to react to downloads one by one; the channel is
+// closed when all links have been processed or ctx is cancelled. The caller must drain it.
+func downloadStream(ctx context.Context, options downloadOptions, links []string, outputDir string, concurrency int) <-chan Result {
+	// Always run at least one worker.
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// Downloads under way when the run is cancelled, say by Ctrl-C, get options.grace to finish
+	// so their files are saved and recorded, while no new ones start.
+	transfers, cancelTransfers := context.WithCancel(context.WithoutCancel(ctx))
+	stopGrace := context.AfterFunc(ctx, func() {
+		if options.grace > 0 {
+			slog.Warn("stopping, giving the downloads in flight time to finish", "grace", options.grace)
+		}
+		time.AfterFunc(options.grace, cancelTransfers)
+	})
+	// In strict mode the first failure cancels everything still queued or in flight.
+	ctx, cancel := context.WithCancel(ctx)
+	// With -max-files each download needs one of maxFiles tokens. A success keeps its token and
+	// a skip or failure hands it back, so exactly maxFiles files are saved and no download in
+	// flight is cut off when the cap is reached.
+	var budget chan struct{}
+	capReached := make(chan struct{})
+	if options.maxFiles > 0 {
+		budget = make(chan struct{}, options.maxFiles)
+		for range options.maxFiles {
+			budget <- struct{}{}
+		}
+	}
+	// Feed the links to the workers through a channel.
+	jobs := make(chan string)
+	// Collect the outcome of every download through a second channel.
+	results := make(chan Result)
+	var waitGroup sync.WaitGroup
+	// Start the workers.
+	for range concurrency {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for link := range jobs {
+				// A link may still be handed over as the run is cancelled.
+				if ctx.Err() != nil {
+					return
+				}
+				// A link handed over twice, perhaps in another form, is only downloaded once.
+				if options.claimed != nil && !options.claimed.Add(link) {
+					results <- newResult(link, outputDir, Record{}, fmt.Errorf("download %s: %w", link, errDuplicateURL), 0)
+					continue
+				}
+				if budget != nil {
+					select {
+					case <-budget:
+					case <-capReached:
+						return
+					case <-ctx.Done():
+						return
+					}
+				}
+				started := time.Now()
+				record, err := downloadWithRecover(transfers, options, link, outputDir)
+				if budget != nil && err != nil {
+					budget <- struct{}{}
+				}
+				elapsed := time.Since(started)
+				// Point out the downloads dragging the run out, whatever their outcome.
+				if options.slowThreshold > 0 && elapsed > options.slowThreshold {
+					slog.Warn("slow download", "url", link, "elapsed", elapsed.Round(time.Millisecond), "threshold", options.slowThreshold)
+				}
+				results <- newResult(link, outputDir, record, err, elapsed)
+			}
+		}()
+	}
+	// Hand out the links, stopping early on cancellation, and signal the workers that there are no more.
+	go func() {
+		defer close(jobs)
+		for _, link := range links {
+			select {
+			case jobs <- link:
+			case <-capReached:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// Close the results once every worker has finished.
+	go func() {
+		waitGroup.Wait()
+		close(results)
+	}()
+	// Keep the books on every result, then pass it on to the caller.
+	stream := make(chan Result)
+	go func() {
+		defer close(stream)
+		defer cancel()
+		defer cancelTransfers()
+		defer stopGrace()
+		succeeded := 0
+		for result := range results {
+			if result.Err == nil {
+				succeeded++
+				if succeeded == options.maxFiles {
+					slog.Info("reached the cap, leaving the remaining links alone", "max_files", options.maxFiles)
+					close(capReached)
+				}
+			}
+			if options.strict && result.Err != nil && !IsSkip(result.Err) && ctx.Err() == nil {
+				slog.Error("stopping after the first failure", "url", result.URL, "error", result.Err)
+				cancel()
+				cancelTransfers()
+			}
+			// Once the disk is full every other download would fail too, after using the
+			// server's bandwidth for nothing.
+			if isDiskFull(result.Err) && ctx.Err() == nil {
+				slog.Error("the output disk is full, stopping the run", "url", result.URL, "error", result.Err)
+				cancel()
+				cancelTransfers()
+			}
+			stream <- result
+		}
+	}()
+	return stream
+}
+
+// downloadWithRecover runs downloadPDF and turns any panic into an error so a single bad link
+// can't take down the worker that is processing it.
+func downloadWithRecover(ctx context.Context, options downloadOptions, link, outputDir string) (record Record, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("download %s: panic: %v", link, r)
+		}
+	}()
+	return downloadPDF(ctx, options, link, outputDir)
+}
+
+// downloadPDF downloads a PDF from the given URL and saves it in the specified output directory.
+// It returns ErrAlreadyExists when the file is already present and is safe to call from multiple goroutines.
+// A transfer that breaks off partway is tried again, up to the configured number of attempts.
+// Cancelling ctx aborts the transfer and removes any partial file.
+func downloadPDF(ctx context.Context, options downloadOptions, finalURL, outputDir string) (Record, error) {
+	// A ZIP archive has no PDF signature to check, so it passes like any other document.
+	archive := extract.IsZipLink(finalURL)
+	if archive && options.extractZips {
+		options.anyDocument = true
+	}
+	// With a sharded layout the file goes into a subdirectory, and the record names it relative
+	// to the output directory.
+	root := outputDir
+	shard := options.shardFor(finalURL)
+	if shard != "" {
+		outputDir = filepath.Join(outputDir, shard)
+		if err := options.disk().MkdirAll(outputDir, 0o755); err != nil {
+			return Record{URL: finalURL}, fmt.Errorf("download %s: create directory %s: %w", finalURL, outputDir, err)
+		}
+	}
+	// Two links that come down to the same file are downloaded once, rather than by two
+	// workers that both find it missing and then write it at the same time.
+	destination := filepath.Join(outputDir, strings.ToLower(options.filenameFor(finalURL)))
+	return options.downloadOnce(destination, finalURL, func() (Record, error) {
+		// A URL saved by an earlier run stays done even after its file was moved elsewhere. A file
+		// that is still here goes through the usual checks, so -checksums can catch a corrupted
+		// copy and -refresh can ask the server for a newer one.
+		if options.index.contains(finalURL) && !options.ignoreIndex && !options.force && !fileStillExists(options.disk(), destination) {
+			return Record{URL: finalURL}, fmt.Errorf("download %s: %w: recorded in %s", finalURL, ErrAlreadyExists, IndexFileName)
+		}
+		fileLimitRetries := 0
+		for attempt := 1; ; attempt++ {
+			record, err := downloadPDFOnce(ctx, options, finalURL, outputDir)
+			if shard != "" && record.Filename != "" {
+				record.Filename = path.Join(shard, record.Filename)
+			}
+			if err == nil {
+				// Unpack the PDFs of an archive next to it; an archive that can't be unpacked counts as failed.
+				if archive && options.extractZips {
+					extracted, err := options.extractZipPDFs(filepath.Join(root, filepath.FromSlash(record.Filename)), outputDir, maxExtractedSize)
+					for _, name := range extracted {
+						record.Extracted = append(record.Extracted, path.Join(shard, name))
+					}
+					if err != nil {
+						return record, err
+					}
+					slog.Log(ctx, options.fileLogLevel(), "extracted archive", "url", finalURL, "pdfs", len(extracted))
+				}
+				// A file that can't be published counts as failed, and is downloaded again next time.
+				if err := options.publish(ctx, record, root); err != nil {
+					return record, err
+				}
+				options.runPostCommand(ctx, filepath.Join(root, filepath.FromSlash(record.Filename)))
+				options.index.add(finalURL, record)
+				return record, nil
+			}
+			// Running out of file descriptors passes as other downloads finish and close theirs, so
+			// back off and try again without using up an attempt.
+			if isTooManyOpenFiles(err) && fileLimitRetries < maxFileLimitRetries {
+				fileLimitRetries++
+				attempt--
+				slog.Warn("too many open files, backing off", "url", finalURL, "retry", fileLimitRetries, "error", err)
+				if err = waitToRetry(ctx, fileLimitRetries); err == nil {
+					continue
+				}
+				err = fmt.Errorf("download %s: %w", finalURL, err)
+			}
+			// Only interrupted transfers are retried here; doWithRetry already handles failed requests.
+			if errors.Is(err, errInterrupted) && attempt < options.maxAttempts {
+				slog.Warn("transfer interrupted, retrying", "url", finalURL, "attempt", attempt, "error", err)
+				if err = waitToRetry(ctx, attempt); err == nil {
+					continue
+				}
+				err = fmt.Errorf("download %s: %w", finalURL, err)
+			}
+			// Giving up, so don't leave a partial file kept for resuming behind.
+			if partial := partialPath(options, finalURL, outputDir); partial != "" {
+				removePartial(options.disk(), partial)
+			}
+			return record, err
+		}
+	})
+}
+
+// downloadOnce runs download unless a download into the same file, named by key, is already
+// under way. A caller that waited on another one gets its failure, or ErrAlreadyExists when
+// it succeeded, just as if it had started a moment later.
+func (options downloadOptions) downloadOnce(key, finalURL string, download func() (Record, error)) (Record, error) {
+	if options.inFlight == nil {
+		return download()
+	}
+	ran := false
+	value, err, _ := options.inFlight.Do(key, func() (any, error) {
+		ran = true
+		return download()
+	})
+	record := value.(Record)
+	if ran {
+		return record, err
+	}
+	if err == nil {
+		err = fmt.Errorf("download %s: %w: %s was just downloaded for %s", finalURL, ErrAlreadyExists, record.Filename, record.URL)
+	}
+	return Record{URL: finalURL}, err
+}
+
+// lastModified asks the server for uri's Last-Modified time with a HEAD request. It reports
+// false when the request fails or the header is missing, so the caller can download anyway.
+func (options httpOptions) lastModified(ctx context.Context, uri string) (time.Time, bool) {
+	request, err := options.newRequest(ctx, http.MethodHead, uri)
+	if err != nil {
+		return time.Time{}, false
+	}
+	response, err := options.doWithRetry(request)
+	if err != nil {
+		slog.Debug("HEAD request failed, downloading anyway", "url", uri, "error", err)
+		return time.Time{}, false
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return time.Time{}, false
+	}
+	modified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	return modified, err == nil
+}
+
+// contentLength asks the server for uri's size with a HEAD request. It reports false when the
+// request fails or the response doesn't carry a Content-Length.
+func (options httpOptions) contentLength(ctx context.Context, uri string) (int64, bool) {
+	release, err := options.hostSlots.acquire(ctx, uri)
+	if err != nil {
+		return 0, false
+	}
+	defer release()
+	request, err := options.newRequest(ctx, http.MethodHead, uri)
+	if err != nil {
+		return 0, false
+	}
+	response, err := options.doWithRetry(request)
+	if err != nil {
+		slog.Debug("HEAD request failed", "url", uri, "error", err)
+		return 0, false
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.ContentLength < 0 {
+		return 0, false
+	}
+	return response.ContentLength, true
+}
+
+// BatchSize is what Preflight found out about a batch of links.
+type BatchSize struct {
+	Files   int   // links checked
+	Bytes   int64 // total of the sizes the servers reported
+	Unknown int   // links whose size couldn't be found out
+}
+
+// Preflight sends a HEAD request for every link, concurrency at a time, and adds up the sizes.
+func (session *Session) Preflight(ctx context.Context, links []string, concurrency int) BatchSize {
+	options := session.options
+	size := BatchSize{Files: len(links)}
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	slots := make(chan struct{}, max(concurrency, 1))
+	for _, link := range links {
+		waitGroup.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer waitGroup.Done()
+			defer func() { <-slots }()
+			length, ok := options.contentLength(ctx, link)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if ok {
+				size.Bytes += length
+			} else {
+				size.Unknown++
+			}
+		}()
+	}
+	waitGroup.Wait()
+	return size
+}
+
+// isWriteError reports whether err came from writing the local file rather than reading the body.
+func isWriteError(err error) bool {
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr) && pathErr.Op == "write"
+}
+
+// maxFileLimitRetries is how often downloadPDF backs off when the process runs out of file
+// descriptors before reporting the download as failed.
+const maxFileLimitRetries = 5
+
+// isTooManyOpenFiles reports whether err comes from hitting the process or system limit on
+// open files, whether opening a file or dialling a connection.
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// isDiskFull reports whether err comes from running out of space on the disk being written to.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// errInterrupted is returned by downloadPDFOnce when the body stopped arriving partway.
+var errInterrupted = errors.New("transfer interrupted")
+
+// partialPath returns where the unfinished download of finalURL is kept. It is named after
+// the URL, not the response, so the next attempt can find it before sending its request.
+// It returns an empty string when the URL yields no file name.
+func partialPath(options downloadOptions, finalURL, outputDir string) string {
+	filename := strings.ToLower(options.filenameFor(finalURL))
+	if filename == "" {
+		return ""
+	}
+	return filepath.Join(outputDir, filename) + ".part"
+}
+
+// validatorSuffix is appended to a partial file's path to name the file holding the ETag or
+// Last-Modified date of the revision the partial file is part of.
+const validatorSuffix = ".validator"
+
+// rangeValidator returns the value for an If-Range header that only lets the server send the
+// rest of the document described by header if it hasn't changed: its ETag when that is a
+// strong one, or else its Last-Modified date. It is empty when there is neither.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// removePartial removes the partial file at tempPath together with its validator.
+func removePartial(files fileSystem, tempPath string) {
+	files.Remove(tempPath)
+	files.Remove(tempPath + validatorSuffix)
+}
+
+// contentRangeStart returns the first byte position of a "bytes start-end/total" Content-Range header.
+func contentRangeStart(header string) (int64, bool) {
+	rangeSpec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes ")
+	if !found {
+		return 0, false
+	}
+	start, _, found := strings.Cut(rangeSpec, "-")
+	if !found {
+		return 0, false
+	}
+	position, err := strconv.ParseInt(start, 10, 64)
+	return position, err == nil
+}
+
+// fileHead returns up to size bytes from the start of the file at path in files.
+func fileHead(files fileSystem, path string, size int) ([]byte, error) {
+	opened, err := openFile(files, path)
+	if err != nil {
+		return nil, err
+	}
+	defer opened.Close()
+	head := make([]byte, size)
+	n, err := io.ReadFull(opened, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// downloadPDFOnce makes a single attempt at downloading finalURL into outputDir. When a
+// partial file from an earlier attempt exists it asks the server for the rest with a Range
+// request. The partial file is removed when the attempt fails, except after an interrupted
+// transfer the server lets us resume.
+func downloadPDFOnce(ctx context.Context, options downloadOptions, finalURL, outputDir string) (Record, error) {
+	// Sanitize the URL to generate a safe file name
+	filename := strings.ToLower(options.filenameFor(finalURL))
+	// A URL that can't be parsed has no name; joined to outputDir it would point at the directory itself.
+	if filename == "" {
+		return Record{URL: finalURL}, fmt.Errorf("download %s: %w", finalURL, errNoFilename)
+	}
+
+	// Construct the full file path in the output directory
+	filePath := filepath.Join(outputDir, filename)
+
+	// Stream the body into a temporary file so a partial download never sits at filePath.
+	tempPath := partialPath(options, finalURL, outputDir)
+	files := options.disk()
+
+	// Start the record early so failures still report what was learned about the URL.
+	record := Record{URL: finalURL, Filename: filename}
+
+	// Skip if the file already exists (and, with checksums on, is still intact), unless asked
+	// to check the server for a newer revision or to download it again regardless. Either way
+	// the new copy only replaces the old one once it is complete.
+	var modifiedSince time.Time
+	var etag string
+	exists := false
+	if !options.force {
+		var err error
+		exists, err = alreadyDownloaded(options, filePath)
+		if err != nil {
+			return record, fmt.Errorf("download %s: %w", finalURL, err)
+		}
+	}
+	if exists {
+		if !options.refresh {
+			return record, fmt.Errorf("download %s: %w: %s", finalURL, ErrAlreadyExists, filePath)
+		}
+		if info, err := files.Stat(filePath); err == nil {
+			modifiedSince = info.ModTime()
+		}
+		// The validators the server sent last time beat the file's own time.
+		if entry, ok := options.index.lookup(finalURL); ok {
+			etag = entry.ETag
+			if !entry.LastModified.IsZero() {
+				modifiedSince = entry.LastModified
+			}
+		}
+	}
+
+	// Respect the site's wishes before fetching the file
+	if !options.robots.allowed(ctx, finalURL) {
+		return record, fmt.Errorf("download %s: %w", finalURL, errDisallowedByRobots)
+	}
+
+	// Wait for a free connection slot on this host and hold it until the body is read
+	release, err := options.hostSlots.acquire(ctx, finalURL)
+	if err != nil {
+		return record, fmt.Errorf("download %s: %w", finalURL, err)
+	}
+	defer release()
+
+	// Leave out documents last changed before the cutoff, as far as the server says.
+	if !options.since.IsZero() {
+		if lastModified, ok := options.lastModified(ctx, finalURL); ok && lastModified.Before(options.since) {
+			return record, fmt.Errorf("download %s: %w: last modified %s", finalURL, errTooOld, lastModified.Format(time.DateOnly))
+		}
+	}
+
+	// Pick up where an earlier attempt left off, unless revalidating a finished file. Without
+	// the revision the partial file came from there is no telling whether the rest still fits,
+	// so it is downloaded afresh.
+	var offset int64
+	var ifRange string
+	if info, err := files.Stat(tempPath); err == nil && info.Size() > 0 && modifiedSince.IsZero() && etag == "" {
+		if validator, err := files.ReadFile(tempPath + validatorSuffix); err == nil && len(validator) > 0 {
+			offset, ifRange = info.Size(), string(validator)
+		}
+	}
+
+	// Build the GET request
+	request, err := options.newRequest(ctx, http.MethodGet, finalURL)
+	if err != nil {
+		return record, fmt.Errorf("download %s: %w", finalURL, err)
+	}
+	// Only fetch the body again if it changed since the local copy was saved.
+	if !modifiedSince.IsZero() {
+		request.Header.Set("If-Modified-Since", modifiedSince.UTC().Format(http.TimeFormat))
+	}
+	// Servers that only expose an ETag can still answer 304 to this one.
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	// Only ask for the bytes still missing, and for the whole document if it changed since.
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", ifRange)
+	}
+	// Send it, retrying transient failures
+	resp, err := options.doWithRetry(request)
+	if err != nil {
+		// Keep the status of a server that kept failing, so it shows up in the summary.
+		var failed statusError
+		if errors.As(err, &failed) {
+			record.StatusCode = failed.code
+		}
+		return record, fmt.Errorf("download %s: %w", finalURL, err)
+	}
+	defer resp.Body.Close()
+	record.StatusCode = resp.StatusCode
+	record.ETag = resp.Header.Get("ETag")
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		record.LastModified = lastModified
+	}
+
+	// Keep the local copy when the server says it is still current.
+	if resp.StatusCode == http.StatusNotModified {
+		return record, fmt.Errorf("download %s: %w: %s not modified", finalURL, ErrAlreadyExists, filePath)
+	}
+	// Check HTTP response status
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// The rest must start exactly where the partial file ends, or the pieces won't fit.
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			removePartial(files, tempPath)
+			return record, fmt.Errorf("download %s: %w: server resumed at %q instead of byte %d", finalURL, errInterrupted, resp.Header.Get("Content-Range"), offset)
+		}
+		slog.Log(ctx, options.fileLogLevel(), "resuming download", "url", finalURL, "offset", offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file doesn't fit the document any more; start over on the next attempt.
+		removePartial(files, tempPath)
+		return record, fmt.Errorf("download %s: %w: range from byte %d not satisfiable", finalURL, errInterrupted, offset)
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range (or none was sent), so the body is the whole file.
+		offset = 0
+	default:
+		return record, fmt.Errorf("download %s: unexpected status %s", finalURL, resp.Status)
+	}
+	// Keep what arrived after an interruption only if the server can send the rest later.
+	// Without a validator to send in If-Range, resuming could splice two revisions together.
+	validator := rangeValidator(resp.Header)
+	resumable := (resp.StatusCode == http.StatusPartialContent || strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")) && validator != ""
+	// Check Content-Type header
+	contentType := resp.Header.Get("Content-Type")
+	record.ContentType = contentType
+	// Redirect shims hide the real document, so name the file after where the client ended up.
+	responseFilename := filename
+	if resolvedURL := resp.Request.URL.String(); resolvedURL != finalURL {
+		record.ResolvedURL = resolvedURL
+		slog.Log(ctx, options.fileLogLevel(), "followed redirect", "url", finalURL, "resolved_url", resolvedURL)
+		if resolvedFilename := extract.URLToFilename(resolvedURL); resolvedFilename != "" {
+			responseFilename = options.hashedName(options.keepExtension(resolvedFilename, path.Ext(resp.Request.URL.Path)), finalURL)
+		}
+	}
+	// Prefer the human readable name the server suggests over the one derived from the URL.
+	if suggested := extract.DispositionFilename(resp.Header.Get("Content-Disposition")); suggested != "" {
+		responseFilename = options.hashedName(options.keepExtension(suggested, path.Ext(strings.TrimSuffix(suggested, ".pdf"))), finalURL)
+	} else if !hasExtension(resp.Request.URL) {
+		// A URL without an extension says nothing about the type, so go by the response's.
+		responseFilename = options.keepExtension(responseFilename, extensionForType(contentType))
+	}
+	if responseFilename != filename {
+		filename = responseFilename
+		filePath = filepath.Join(outputDir, filename)
+		record.Filename = filename
+		// The URL based check above can't see files saved under a name only the response reveals.
+		// When refreshing, the server already answered with a new revision, so overwrite it.
+		if !options.refresh && !options.force {
+			exists, err := alreadyDownloaded(options, filePath)
+			if err != nil {
+				return record, fmt.Errorf("download %s: %w", finalURL, err)
+			}
+			if exists {
+				return record, fmt.Errorf("download %s: %w: %s", finalURL, ErrAlreadyExists, filePath)
+			}
+		}
+	}
+	// Check if its pdf (or generic binary) content type and if not than return an error.
+	// The bytes themselves are checked for the PDF signature below. Without a header at all
+	// the type is sniffed from those bytes instead.
+	if contentType == "" {
+		// Checked once the start of the body is at hand.
+	} else if options.anyDocument {
+		// Other document types have too many content types to list, but an HTML page is never one.
+		if strings.Contains(contentType, "text/html") {
+			return record, fmt.Errorf("download %s: invalid content type %q (expected a document)", finalURL, contentType)
+		}
+	} else if !strings.Contains(contentType, "application/pdf") && !strings.Contains(contentType, "application/octet-stream") {
+		return record, fmt.Errorf("download %s: invalid content type %q (expected application/pdf)", finalURL, contentType)
+	}
+	// Don't even start on files the server says are too big.
+	if options.maxSize > 0 && resp.ContentLength >= 0 && offset+resp.ContentLength > options.maxSize {
+		return record, fmt.Errorf("download %s: %w: %d bytes (limit %d)", finalURL, errTooLarge, offset+resp.ContentLength, options.maxSize)
+	}
+	// Placeholder documents are tiny, so reject them before reading the body when possible.
+	if options.minSize > 0 && resp.ContentLength >= 0 && offset+resp.ContentLength < options.minSize {
+		return record, fmt.Errorf("download %s: suspiciously small: %d bytes (minimum %d)", finalURL, offset+resp.ContentLength, options.minSize)
+	}
+	// Look at the start of the file without consuming the body; when resuming it is on disk.
+	body := bufio.NewReader(resp.Body)
+	var head []byte
+	if offset > 0 {
+		head, err = fileHead(files, tempPath, sniffLength)
+	} else {
+		head, err = body.Peek(sniffLength)
+	}
+	if len(head) == 0 {
+		// If 0 bytes are available than return an error.
+		if err != nil && !errors.Is(err, io.EOF) {
+			return record, fmt.Errorf("download %s: read body: %w", finalURL, err)
+		}
+		return record, fmt.Errorf("download %s: received 0 bytes", finalURL)
+	}
+	// A CDN may answer 200 with a "Not Found" page for a missing document; tell those apart
+	// from other bad bodies so missing documents stand out.
+	if looksLikeHTML(head) {
+		return record, fmt.Errorf("download %s: %w (content type %q)", finalURL, ErrSoft404, contentType)
+	}
+	// Some servers leave out Content-Type, so judge those responses by their first bytes.
+	if contentType == "" {
+		sniffed := http.DetectContentType(head)
+		if !options.anyDocument && sniffed != "application/pdf" {
+			return record, fmt.Errorf("download %s: no content type and the body looks like %q (expected application/pdf)", finalURL, sniffed)
+		}
+		slog.Debug("no content type, sniffed the body", "url", finalURL, "content_type", sniffed)
+	}
+	// Servers sometimes send HTML error pages labelled as PDFs, so trust the bytes over the header.
+	// Other document types have no signature to check.
+	if (!options.anyDocument || strings.HasSuffix(filename, ".pdf")) && !hasPDFHeader(head) {
+		return record, fmt.Errorf("download %s: body does not start with the %q signature (content type %q)", finalURL, pdfMagic, contentType)
+	}
+	// Append to the partial file when resuming, otherwise start it afresh.
+	hasher := sha256.New()
+	var out file
+	if offset > 0 {
+		out, err = files.OpenFile(tempPath, os.O_RDWR|os.O_APPEND, 0)
+		// The digest has to cover the bytes from the earlier attempt too.
+		if err == nil {
+			_, err = io.Copy(hasher, io.NewSectionReader(out, 0, offset))
+		}
+	} else {
+		out, err = createFile(files, tempPath)
+	}
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return record, fmt.Errorf("download %s: %w", finalURL, err)
+	}
+	// Remove the temporary file unless it was renamed into place or kept for resuming, in which
+	// case its validator is stored with it.
+	saved := false
+	keepPartial := false
+	defer func() {
+		out.Close()
+		switch {
+		case keepPartial:
+			if err := files.WriteFile(tempPath+validatorSuffix, []byte(validator), 0o644); err != nil {
+				removePartial(files, tempPath)
+			}
+		case saved:
+			files.Remove(tempPath + validatorSuffix)
+		default:
+			removePartial(files, tempPath)
+		}
+	}()
+	// Without a Content-Length the size is only known while copying, so read at most one
+	// byte past the limit to detect an oversized file.
+	var source io.Reader = body
+	if options.maxSize > 0 {
+		source = io.LimitReader(body, options.maxSize-offset+1)
+	}
+	// Share the configured bandwidth with every other download in flight.
+	source = throttle(ctx, source, options.bandwidth)
+	// Copy the body to the file, hashing it on the way.
+	written, err := io.Copy(io.MultiWriter(out, hasher), source)
+	if err != nil {
+		// A failed read means the connection broke off; a failed write is a local problem.
+		if ctx.Err() == nil && !isWriteError(err) {
+			keepPartial = resumable
+			return record, fmt.Errorf("download %s: %w: %w", finalURL, errInterrupted, err)
+		}
+		return record, fmt.Errorf("download %s: write %s: %w", finalURL, tempPath, err)
+	}
+	size := offset + written
+	if options.maxSize > 0 && size > options.maxSize {
+		return record, fmt.Errorf("download %s: %w: more than %d bytes", finalURL, errTooLarge, options.maxSize)
+	}
+	if size < options.minSize {
+		return record, fmt.Errorf("download %s: suspiciously small: %d bytes (minimum %d)", finalURL, size, options.minSize)
+	}
+	// A body shorter (or longer) than the advertised Content-Length means the transfer was cut off,
+	// so don't save a file that looks valid but won't open.
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		keepPartial = resumable && written < resp.ContentLength
+		return record, fmt.Errorf("download %s: %w: truncated at %d of %d bytes", finalURL, errInterrupted, size, offset+resp.ContentLength)
+	}
+	// Flush the file before moving it into place.
+	if err := out.Close(); err != nil {
+		return record, fmt.Errorf("download %s: close %s: %w", finalURL, tempPath, err)
+	}
+	// Make sure the document really opens, not just that it starts like a PDF.
+	if options.validatePDF && strings.HasSuffix(filename, ".pdf") {
+		pages, err := pdfPageCount(files, tempPath)
+		if err != nil {
+			return record, fmt.Errorf("download %s: %w: %w", finalURL, errCorruptPDF, err)
+		}
+		record.Pages = pages
+	}
+	// Keep the server's publication date on the file so listings and backups reflect it.
+	if lastModified := record.LastModified; !lastModified.IsZero() {
+		if err := files.Chtimes(tempPath, lastModified, lastModified); err != nil {
+			slog.Warn("unable to set modification time", "path", tempPath, "error", err)
+		}
+	}
+	// Atomically move the complete file to its final name, or link it to an identical file
+	// saved earlier in the run.
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	original, err := options.contentHashes.place(files, hash, tempPath, filePath)
+	if err != nil {
+		return record, fmt.Errorf("download %s: %w", finalURL, err)
+	}
+	if original != "" {
+		slog.Log(ctx, options.fileLogLevel(), "content duplicate linked instead of saved again", "url", finalURL, "path", filePath, "original", original)
+	} else {
+		saved = true
+		slog.Log(ctx, options.fileLogLevel(), "downloaded", "url", finalURL, "resolved_url", resp.Request.URL.String(), "path", filePath, "bytes", size)
+	}
+	// Record the digest next to the file so it can be verified later.
+	if options.checksums {
+		if err := writeChecksumFile(files, filePath, hash); err != nil {
+			slog.Warn("unable to write checksum file", "path", filePath, "error", err)
+		}
+	}
+	record.Size = size
+	record.SHA256 = hash
+	record.DownloadedAt = time.Now().UTC()
+	return record, nil
+}
+
+// downloadOptions holds the settings shared by every PDF download in a run.
+type downloadOptions struct {
+	httpOptions
+	contentHashes *contentIndex       // files saved so far, keyed by content hash
+	checksums     bool                // write .sha256 sidecars and verify existing files against them
+	maxSize       int64               // largest file to download in bytes; 0 means no limit
+	minSize       int64               // smallest file to keep in bytes; smaller ones are placeholders
+	quiet         bool                // demote per-file success logs so only the progress line shows
+	refresh       bool                // revalidate existing files with If-Modified-Since instead of skipping them
+	force         bool                // download and overwrite existing files instead of skipping them
+	hashNames     bool                // add a short hash of the URL to file names so distinct URLs never collide
+	strict        bool                // abort the remaining downloads after the first failure
+	bandwidth     *rate.Limiter       // shared cap on download bytes per second; nil means unlimited
+	anyDocument   bool                // -pattern picks the links, so accept documents other than PDFs
+	since         time.Time           // skip files the server says were last modified before this; zero disables
+	layout        string              // how files are spread over subdirectories: LayoutFlat, LayoutHash or LayoutHost
+	sink          Sink                // also receives every saved file; nil keeps them only in the output directory
+	postCommand   []string            // program and arguments run with each saved file's path appended; empty runs nothing
+	flatNames     map[string]string   // -flatten-names: URL to its basename, for the URLs whose basename is unique
+	claimed       *URLSet             // URLs already handed to a worker; nil disables the check
+	slowThreshold time.Duration       // warn about downloads taking longer than this; 0 disables the warning
+	index         *Index              // URLs downloaded by any run into this output directory; nil keeps no record
+	ignoreIndex   bool                // download URLs the index already lists, as long as their files are gone
+	validatePDF   bool                // open every PDF and count its pages, rejecting those that don't parse
+	maxFiles      int                 // stop once this many files were downloaded; skips don't count; 0 means no cap
+	extractZips   bool                // download .zip links and unpack the PDFs inside them
+	grace         time.Duration       // how long downloads in flight may finish once the run is cancelled; 0 aborts them
+	inFlight      *singleflight.Group // downloads under way, keyed by destination file; nil doesn't guard against two at once
+	files         fileSystem          // where downloads are written; nil means the real disk
+}
+
+// disk returns the fileSystem downloads are written to.
+func (options downloadOptions) disk() fileSystem {
+	if options.files == nil {
+		return osFileSystem{}
+	}
+	return options.files
+}
+
+// FlatNames maps each link to its bare file name (see extract.BasenameFilename) when no
+// other link in the run shares that name. Colliding links are left out so they keep the full
+// URL based name; deciding from the whole list keeps the names independent of download order.
+func FlatNames(links []string) map[string]string {
+	users := make(map[string]int)
+	for _, link := range extract.RemoveDuplicatesFromSlice(links) {
+		users[extract.BasenameFilename(link)]++
+	}
+	names := make(map[string]string)
+	for _, link := range links {
+		name := extract.BasenameFilename(link)
+		if name != "" && users[name] == 1 {
+			names[link] = name
+		}
+	}
+	return names
+}
+
+// runPostCommand runs the -post-command on a freshly saved file. A failing command is logged
+// with its exit code and output but doesn't fail the download or stop the run.
+func (options downloadOptions) runPostCommand(ctx context.Context, filePath string) {
+	if len(options.postCommand) == 0 {
+		return
+	}
+	command := exec.CommandContext(ctx, options.postCommand[0], slices.Concat(options.postCommand[1:], []string{filePath})...)
+	output, err := command.CombinedOutput()
+	if err != nil {
+		slog.Error("post-command failed", "file", filePath, "exit_code", command.ProcessState.ExitCode(), "error", err, "output", strings.TrimSpace(string(output)))
+		return
+	}
+	slog.Log(ctx, options.fileLogLevel(), "post-command finished", "file", filePath)
+}
+
+// filenameFor returns the file name a PDF from uri is saved under.
+func (options downloadOptions) filenameFor(uri string) string {
+	filename := extract.URLToFilename(uri)
+	flat, isFlat := options.flatNames[uri]
+	if isFlat {
+		filename = flat
+	}
+	if parsed, err := url.Parse(uri); err == nil {
+		filename = options.keepExtension(filename, path.Ext(parsed.Path))
+	}
+	// Flattened names are already unique among the links.
+	if !isFlat {
+		filename = options.hashedName(filename, uri)
+	}
+	return filename
+}
+
+// hashedName adds the hash of the requested link to filename when -hash-names is set. Names
+// taken from a redirect or a Content-Disposition header are hashed with the link as well,
+// since several links can lead to one place or be given one name.
+func (options downloadOptions) hashedName(filename, link string) string {
+	if !options.hashNames {
+		return filename
+	}
+	return extract.HashName(filename, link)
+}
+
+// filenameCollisions maps every file name, relative to the output directory, that more than
+// one of the links would be saved under to those links. Only the first link to reach such a
+// file gets downloaded; the others are skipped as already present.
+func filenameCollisions(options downloadOptions, links []string) map[string][]string {
+	users := make(map[string][]string)
+	for _, link := range extract.RemoveDuplicatesFromSlice(links) {
+		name := path.Join(options.shardFor(link), options.filenameFor(link))
+		users[name] = append(users[name], link)
+	}
+	maps.DeleteFunc(users, func(_ string, links []string) bool {
+		return len(links) < 2
+	})
+	return users
+}
+
+// Output layouts for Options.Layout.
+const (
+	LayoutFlat = "flat" // every file directly in the output directory
+	LayoutHash = "hash" // subdirectories named after the first two hex characters of the URL's SHA-256
+	LayoutHost = "host" // subdirectories named after the URL's host
+)
+
+// shardFor returns the subdirectory of the output directory a file from uri goes into,
+// or an empty string for the flat layout.
+func (options downloadOptions) shardFor(uri string) string {
+	switch options.layout {
+	case LayoutHash:
+		sum := sha256.Sum256([]byte(uri))
+		return hex.EncodeToString(sum[:1])
+	case LayoutHost:
+		parsed, err := url.Parse(uri)
+		if err != nil || parsed.Host == "" {
+			return ""
+		}
+		// Ports are separated by a colon, which Windows doesn't allow in names.
+		return strings.ReplaceAll(strings.ToLower(parsed.Host), ":", "_")
+	default:
+		return ""
+	}
+}
+
+// keepExtension swaps the .pdf extension the sanitizer forces on every name for extension when
+// other document types (or, with -extract-zips, archives) are accepted, so sds.xlsx isn't saved
+// as sds.xlsx.pdf.
+func (options downloadOptions) keepExtension(filename, extension string) string {
+	extension = strings.ToLower(extension)
+	if !options.anyDocument && !(options.extractZips && extension == ".zip") || filename == "" || extension == "" || extension == ".pdf" {
+		return filename
+	}
+	base := strings.TrimSuffix(filename, ".pdf")
+	if strings.HasSuffix(base, extension) {
+		return base
+	}
+	return base + extension
+}
+
+// hasExtension reports whether the last segment of target's path has an extension.
+func hasExtension(target *url.URL) bool {
+	return path.Ext(target.Path) != ""
+}
+
+// documentExtensions maps the document types Go's built-in MIME table doesn't know to their
+// extensions, so the names don't depend on whether the host has a mime.types file.
+var documentExtensions = map[string]string{
+	"application/msword":            ".doc",
+	"application/vnd.ms-excel":      ".xls",
+	"application/vnd.ms-powerpoint": ".ppt",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/rtf": ".rtf",
+	"application/zip": ".zip",
+	"text/csv":        ".csv",
+}
+
+// extensionForType returns the file extension registered for contentType, such as .xlsx for
+// application/vnd.openxmlformats-officedocument.spreadsheetml.sheet, or an empty string when the
+// type is unknown or says nothing about the format, like application/octet-stream.
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if extension, ok := documentExtensions[mediaType]; ok {
+		return extension
+	}
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
+
+// fileLogLevel is the level for per-file success messages.
+func (options downloadOptions) fileLogLevel() slog.Level {
+	if options.quiet {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// checksumSuffix is appended to a PDF's path to name its checksum sidecar.
+const checksumSuffix = ".sha256"
+
+// alreadyDownloaded reports whether filePath can be skipped. With checksums enabled, a file
+// whose content no longer matches its sidecar is treated as missing so it gets downloaded again.
+// It returns an error when filePath can't be checked, since downloading to it would fail too.
+func alreadyDownloaded(options downloadOptions, filePath string) (bool, error) {
+	exists, err := fileExists(options.disk(), filePath)
+	if err != nil || !exists {
+		return false, err
+	}
+	if !options.checksums {
+		return true, nil
+	}
+	matches, err := checksumMatches(options.disk(), filePath)
+	if err != nil {
+		slog.Warn("unable to verify checksum", "path", filePath, "error", err)
+		return true, nil
+	}
+	if !matches {
+		slog.Warn("checksum mismatch, downloading again", "path", filePath)
+	}
+	return matches, nil
+}
+
+// writeChecksumFile writes hash in sha256sum format to the sidecar of filePath.
+func writeChecksumFile(files fileSystem, filePath, hash string) error {
+	line := hash + "  " + filepath.Base(filePath) + "\n"
+	return files.WriteFile(filePath+checksumSuffix, []byte(line), 0o644)
+}
+
+// checksumMatches reports whether the file at filePath still matches its sidecar.
+// A file without a sidecar can't be checked and is assumed to be intact.
+func checksumMatches(files fileSystem, filePath string) (bool, error) {
+	sidecar, err := files.ReadFile(filePath + checksumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(sidecar))
+	if len(fields) == 0 {
+		return false, fmt.Errorf("empty checksum file for %s", filePath)
+	}
+	actual, err := fileSHA256(files, filePath)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(fields[0], actual), nil
+}
+
+// contentIndex remembers which file holds each piece of content so identical PDFs served
+// from different URLs are only stored once. It is safe for concurrent use.
+type contentIndex struct {
+	mutex sync.Mutex
+	files map[string]string // SHA-256 hex digest to file path
+}
+
+// newContentIndex returns an empty contentIndex.
+func newContentIndex() *contentIndex {
+	return &contentIndex{files: make(map[string]string)}
+}
+
+// place moves tempPath to filePath unless a file with the same hash was already placed,
+// in which case filePath becomes a hard link to that file and its path is returned.
+// The lock is held across the filesystem work so a duplicate never links to a file that
+// hasn't been renamed into place yet.
+func (index *contentIndex) place(files fileSystem, hash, tempPath, filePath string) (string, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	// The original may have been moved away since, in which case this copy takes its place.
+	if original, ok := index.files[hash]; ok && original != filePath && fileStillExists(files, original) {
+		// Replace a stale copy, e.g. one that failed checksum verification.
+		if err := files.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if err := files.Link(original, filePath); err != nil {
+			return "", fmt.Errorf("link duplicate of %s: %w", original, err)
+		}
+		return original, nil
+	}
+	if err := files.Rename(tempPath, filePath); err != nil {
+		return "", err
+	}
+	index.files[hash] = filePath
+	return "", nil
+}
+
+// fileStillExists reports whether path can still be found; an unreadable path counts as present
+// so the error surfaces from the operation on it.
+func fileStillExists(files fileSystem, path string) bool {
+	exists, err := fileExists(files, path)
+	return exists || err != nil
+}
+
+// DefaultUserAgent identifies the scraper to the servers it talks to.
+const DefaultUserAgent = "ipcol-doc-scraper/1.0"
+
+// httpOptions holds the settings shared by every outbound request.
+type httpOptions struct {
+	client        *http.Client     // shared client used for all requests
+	userAgent     string           // value of the User-Agent header
+	maxAttempts   int              // attempts per request before giving up
+	robots        *robotsChecker   // robots.txt gate; nil allows everything
+	limiter       *hostRateLimiter // per-host request rate; nil means unlimited
+	jitter        time.Duration    // longest random delay added before each request; 0 adds none
+	hostSlots     *hostSemaphore   // per-host cap on in-flight requests; nil means unlimited
+	authorization string           // value of the Authorization header; empty sends none. Never log it.
+	authHosts     map[string]bool  // lower case host names the Authorization header is sent to
+	headers       http.Header      // extra headers from -header; may hold secrets, so never log them
+}
+
+// newRequest builds a request bound to ctx carrying the configured headers.
+func (options httpOptions) newRequest(ctx context.Context, method, uri string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", options.userAgent)
+	// Extracted links can point anywhere, so the credentials only go to the hosts they are for.
+	if options.authorization != "" && options.authHosts[strings.ToLower(request.URL.Hostname())] {
+		request.Header.Set("Authorization", options.authorization)
+	}
+	// Headers the user spelled out win over the ones above.
+	for name, values := range options.headers {
+		request.Header[name] = slices.Clone(values)
+	}
+	return request, nil
+}
+
+// pdfMagic is the signature every PDF file starts with.
+const pdfMagic = "%PDF-"
+
+// sniffLength is how much of the start of a body is inspected before it is saved.
+const sniffLength = 512
+
+// pdfPageCount opens the PDF at path in files and returns its number of pages. The parser only
+// knows PDF 1.x, so newer files are reported as having zero pages rather than as corrupt.
+func pdfPageCount(files fileSystem, path string) (pages int, err error) {
+	head, err := fileHead(files, path, len(pdfMagic)+1)
+	if err != nil {
+		return 0, err
+	}
+	if string(head) == pdfMagic+"2" {
+		slog.Debug("PDF 2.0 can't be validated", "path", path)
+		return 0, nil
+	}
+	// The parser panics on some malformed input.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("parse: %v", r)
+		}
+	}()
+	opened, err := openFile(files, path)
+	if err != nil {
+		return 0, err
+	}
+	defer opened.Close()
+	info, err := opened.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader, err := pdf.NewReader(opened, info.Size())
+	if err != nil {
+		return 0, err
+	}
+	pages = reader.NumPage()
+	if pages == 0 {
+		return 0, errors.New("no pages")
+	}
+	return pages, nil
+}
+
+// looksLikeHTML reports whether data starts like an HTML document, ignoring a byte order
+// mark, leading whitespace and letter case.
+func looksLikeHTML(data []byte) bool {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	for _, marker := range []string{"<!doctype html", "<html"} {
+		if len(data) >= len(marker) && strings.EqualFold(string(data[:len(marker)]), marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPDFHeader reports whether data starts with the PDF signature.
+func hasPDFHeader(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(pdfMagic))
+}
+
+// doWithRetry sends a body-less request and retries network errors and 5xx responses with
+// exponential backoff plus jitter. Other responses, including 4xx, are returned as is.
+// Every attempt waits for the host's rate limiter first.
+func (options httpOptions) doWithRetry(request *http.Request) (*http.Response, error) {
+	// Always make at least one attempt.
+	maxAttempts := options.maxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		// Wait before every attempt but the first, giving up if the request is cancelled meanwhile.
+		if attempt > 1 {
+			if err := waitToRetry(request.Context(), attempt-1); err != nil {
+				return nil, err
+			}
+		}
+		// Stay within the per-host request rate.
+		if err := options.limiter.wait(request.Context(), request.URL.String()); err != nil {
+			return nil, err
+		}
+		// Then wait a little more at random, so the pace doesn't look mechanical.
+		if err := waitJitter(request.Context(), options.jitter); err != nil {
+			return nil, err
+		}
+		resp, err := options.client.Do(request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Server errors are worth another try; everything else goes back to the caller.
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			lastErr = statusError{code: resp.StatusCode, status: resp.Status}
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", maxAttempts, lastErr)
+}
+
+// statusError reports a response whose status meant the request failed.
+type statusError struct {
+	code   int    // the HTTP status code, e.g. 503
+	status string // the status line, e.g. "503 Service Unavailable"
+}
+
+func (err statusError) Error() string {
+	return "server returned " + err.status
+}
+
+// retryDelay returns the backoff before the given retry (1-based): the base delay doubled
+// for each previous retry, plus up to 50% random jitter.
+func retryDelay(retry int) time.Duration {
+	delay := retryBaseDelay << (retry - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay + rand.N(delay/2+1)
+}
+
+// waitToRetry sleeps for the backoff before the given retry, returning early with the
+// context's error if ctx is cancelled meanwhile.
+func waitToRetry(ctx context.Context, retry int) error {
+	timer := time.NewTimer(retryDelay(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Fetcher fetches the listing pages the links are extracted from. The crawler only talks to
+// the network through it, so tests can hand it canned HTML.
+type Fetcher interface {
+	// Fetch returns the body of the page at uri, or an error when it can't be loaded.
+	Fetch(ctx context.Context, uri string) ([]byte, error)
+}
+
+// httpFetcher is the Fetcher used by a real run: getDataFromURL with the run's HTTP settings.
+type httpFetcher struct {
+	options httpOptions
+}
+
+// Fetch implements Fetcher.
+func (fetcher httpFetcher) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	return getDataFromURL(ctx, fetcher.options, uri)
+}
+
+// Send a http get request to a given url and return the data from that url.
+// An error is returned when the request fails or the server doesn't answer 200 OK.
+func getDataFromURL(ctx context.Context, options httpOptions, uri string) ([]byte, error) {
+	release, err := options.hostSlots.acquire(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", uri, err)
+	}
+	defer release()
+	request, err := options.newRequest(ctx, http.MethodGet, uri)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", uri, err)
+	}
+	response, err := options.doWithRetry(request)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", uri, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: unexpected status %s", uri, response.Status)
+	}
+	// Decode compressed pages ourselves; the transport only does so when it asked for gzip.
+	reader, err := decodedBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", uri, err)
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: read body: %w", uri, err)
+	}
+	return body, nil
+}
+
+// decodedBody returns response's body with any gzip or deflate Content-Encoding removed.
+// Bodies the transport already decompressed no longer carry the header and pass through as is.
+func decodedBody(response *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode gzip body: %w", err)
+		}
+		return reader, nil
+	case "deflate":
+		reader, err := zlib.NewReader(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode deflate body: %w", err)
+		}
+		return reader, nil
+	default:
+		return io.NopCloser(response.Body), nil
+	}
+}
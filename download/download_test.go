@@ -0,0 +1,1576 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestExtractPDFLinksFromServer(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	data, err := getDataFromURL(context.Background(), options.httpOptions, server.URL+"/sds")
+	if err != nil {
+		t.Fatalf("getDataFromURL() error = %v", err)
+	}
+	got := extract.RemoveDuplicatesFromSlice(extract.PDFLinks(string(data), server.URL+"/sds"))
+	want := []string{server.URL + "/files/a.pdf", server.URL + "/files/b.pdf"}
+	if !slices.Equal(got, want) {
+		t.Errorf("extracted links = %q, want %q", got, want)
+	}
+}
+
+func TestExtractPDFLinksFromGzipPage(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	io.WriteString(writer, `<a href="/files/a.pdf">A</a>`)
+	writer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	// Turn off the transport's own decompression so getDataFromURL has to do it.
+	options := testDownloadOptions(server)
+	options.client = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	data, err := getDataFromURL(context.Background(), options.httpOptions, server.URL+"/sds")
+	if err != nil {
+		t.Fatalf("getDataFromURL() error = %v", err)
+	}
+	got := extract.PDFLinks(string(data), server.URL+"/sds")
+	if want := []string{server.URL + "/files/a.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("extracted links = %q, want %q", got, want)
+	}
+}
+
+func TestCollectPDFLinksIgnoresSelfLink(t *testing.T) {
+	// The listing's own URL ends in .pdf and the page links back to itself.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/sds?format=list.pdf">This page</a>
+<a href="/files/a.pdf">A</a>`)
+	}))
+	t.Cleanup(server.Close)
+	// Listing pages are cached in the working directory.
+	t.Chdir(t.TempDir())
+	options := testDownloadOptions(server)
+	seed := server.URL + "/sds?format=list.pdf"
+
+	got, err := (&Session{options: options.httpOptions}).CollectLinks(context.Background(), Crawl{MaxPages: 1}, []string{seed})
+	if err != nil {
+		t.Fatalf("CollectLinks() error = %v", err)
+	}
+	if want := []string{server.URL + "/files/a.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("CollectLinks() = %q, want %q", got, want)
+	}
+	// Even if the listing slipped through, its HTML must never be saved as a PDF.
+	outputDir := t.TempDir()
+	if _, err := downloadPDF(context.Background(), options, seed, outputDir); err == nil {
+		t.Error("downloadPDF() of the listing page succeeded, want an error")
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+// fakeFetcher serves canned pages keyed by URL and counts the requests.
+type fakeFetcher struct {
+	pages    map[string]string
+	requests atomic.Int32
+}
+
+func (fetcher *fakeFetcher) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	fetcher.requests.Add(1)
+	page, ok := fetcher.pages[uri]
+	if !ok {
+		return nil, fmt.Errorf("fetch %s: unexpected status 404 Not Found", uri)
+	}
+	return []byte(page), nil
+}
+
+func TestCollectPDFLinksWithFakeFetcher(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fetcher := &fakeFetcher{pages: map[string]string{
+		"https://ipcol.com/sds":        `<a href="/files/a.pdf">A</a> <a rel="next" href="/sds?page=2">Next</a>`,
+		"https://ipcol.com/sds?page=2": `<a href="/files/b.pdf">B</a> <a href="/files/a.pdf">A</a>`,
+	}}
+	crawl := Crawl{MaxPages: 10, Fetcher: fetcher, Concurrency: 2}
+
+	got, err := (&Session{}).CollectLinks(context.Background(), crawl, []string{"https://ipcol.com/sds", "https://ipcol.com/gone"})
+	if want := []string{"https://ipcol.com/files/a.pdf", "https://ipcol.com/files/b.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("CollectLinks() = %q, want %q", got, want)
+	}
+	if !errors.Is(err, errListingUnavailable) {
+		t.Errorf("CollectLinks() error = %v, want errListingUnavailable for the missing listing", err)
+	}
+	if got := fetcher.requests.Load(); got != 3 {
+		t.Errorf("fetcher saw %d requests, want 3", got)
+	}
+}
+
+func TestLinksFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "listing.html")
+	page := `<a href="/files/a.pdf">A</a> <a href="https://ipcol.com/files/a.pdf#top">A again</a> <a href="b.pdf">B</a>` +
+		` <a href="c.pdf?name=SDS%20sheet&download">C</a> <a href="d.pdf?x=1;y=2">D</a>`
+	if err := os.WriteFile(path, []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LinksFromFile(Crawl{}, path, "https://ipcol.com/sds/")
+	if err != nil {
+		t.Fatalf("LinksFromFile() error = %v", err)
+	}
+	// The links are kept as written, since rewriting a query can name another document.
+	want := []string{
+		"https://ipcol.com/files/a.pdf",
+		"https://ipcol.com/sds/b.pdf",
+		"https://ipcol.com/sds/c.pdf?name=SDS%20sheet&download",
+		"https://ipcol.com/sds/d.pdf?x=1;y=2",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("LinksFromFile() = %q, want %q", got, want)
+	}
+	if _, err := LinksFromFile(Crawl{}, path+".missing", "https://ipcol.com/"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LinksFromFile() of a missing file error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLinksCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.json")
+	source := Crawl{MaxPages: 5}.Source([]string{"https://ipcol.com/sds"})
+	links := []string{"https://ipcol.com/a.pdf", "https://ipcol.com/b.pdf"}
+	if err := SaveLinksCache(path, source, links); err != nil {
+		t.Fatalf("SaveLinksCache() error = %v", err)
+	}
+
+	got, ok := LoadLinksCache(path, source, time.Hour)
+	if !ok || !slices.Equal(got, links) {
+		t.Errorf("LoadLinksCache() = %v, %v, want %v, true", got, ok, links)
+	}
+	// Other listings or an expired cache mean extracting again.
+	other := Crawl{MaxPages: 5}.Source([]string{"https://ipcol.com/other"})
+	if _, ok := LoadLinksCache(path, other, time.Hour); ok {
+		t.Error("LoadLinksCache() reused links cached for other listings")
+	}
+	if _, ok := LoadLinksCache(path, source, 0); ok {
+		t.Error("LoadLinksCache() reused an expired cache")
+	}
+}
+
+func TestPreflightTotalsKnownSizes(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	links := []string{server.URL + "/files/a.pdf", server.URL + "/files/b.pdf", server.URL + "/files/missing.pdf"}
+
+	size := (&Session{options: options.httpOptions}).Preflight(context.Background(), links, 2)
+	want := BatchSize{Files: 3, Bytes: int64(len(testPDF+"/files/a.pdf") + len(testPDF+"/files/b.pdf")), Unknown: 1}
+	if size != want {
+		t.Errorf("Preflight() = %+v, want %+v", size, want)
+	}
+}
+
+func TestDownloadPDF(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	outputDir := t.TempDir()
+	link := server.URL + "/files/a.pdf"
+
+	record, err := downloadPDF(context.Background(), options, link, outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, record.Filename))
+	if err != nil {
+		t.Fatalf("reading downloaded file: %v", err)
+	}
+	if want := testPDF + "/files/a.pdf"; string(data) != want {
+		t.Errorf("downloaded content = %q, want %q", data, want)
+	}
+	if record.Size != int64(len(data)) || record.StatusCode != http.StatusOK {
+		t.Errorf("record = %+v, want size %d and status 200", record, len(data))
+	}
+	// No temporary file may be left behind.
+	if exists, _ := fileExists(osFileSystem{}, filepath.Join(outputDir, record.Filename)+".part"); exists {
+		t.Error("temporary .part file left behind")
+	}
+
+	// A second download of the same link is skipped.
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("second downloadPDF() error = %v, want ErrAlreadyExists", err)
+	}
+}
+
+func TestDownloadPDFHashesSuggestedNames(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="SDS.pdf"`)
+		io.WriteString(w, testPDF+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.hashNames = true
+	outputDir := t.TempDir()
+
+	// Both documents suggest the same name, but each must get a file of its own.
+	names := make(map[string]bool)
+	for _, link := range []string{server.URL + "/a/one.pdf", server.URL + "/b/two.pdf"} {
+		record, err := downloadPDF(context.Background(), options, link, outputDir)
+		if err != nil {
+			t.Fatalf("downloadPDF(%q) error = %v", link, err)
+		}
+		if !strings.HasPrefix(record.Filename, "sds_") || !strings.HasSuffix(record.Filename, ".pdf") {
+			t.Errorf("downloadPDF(%q) saved %q, want sds_<hash>.pdf", link, record.Filename)
+		}
+		names[record.Filename] = true
+	}
+	if len(names) != 2 {
+		t.Errorf("saved files = %v, want two distinct names", names)
+	}
+}
+
+func TestDownloadPDFForceOverwrites(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	outputDir := t.TempDir()
+	link := server.URL + "/files/a.pdf"
+	filePath := filepath.Join(outputDir, options.filenameFor(link))
+	if err := os.WriteFile(filePath, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	options.force = true
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Fatalf("downloadPDF() with force error = %v", err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testPDF + "/files/a.pdf"; string(data) != want {
+		t.Errorf("content after forced download = %q, want %q", data, want)
+	}
+}
+
+func TestDownloadPDFReplacesFilesFailingChecksum(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.checksums = true
+	outputDir := t.TempDir()
+	link := server.URL + "/files/a.pdf"
+	record, err := downloadPDF(context.Background(), options, link, outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	filePath := filepath.Join(outputDir, record.Filename)
+	sidecar, err := os.ReadFile(filePath + checksumSuffix)
+	if err != nil {
+		t.Fatalf("reading checksum file: %v", err)
+	}
+	if want := record.SHA256 + "  " + record.Filename + "\n"; string(sidecar) != want {
+		t.Errorf("checksum file = %q, want %q", sidecar, want)
+	}
+
+	// An intact file is skipped.
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("downloadPDF() of an intact file error = %v, want ErrAlreadyExists", err)
+	}
+	// A corrupted one is downloaded again.
+	if err := os.WriteFile(filePath, []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Fatalf("downloadPDF() of a corrupted file error = %v, want it downloaded again", err)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != testPDF+"/files/a.pdf" {
+		t.Errorf("file content = %q, want the downloaded PDF", data)
+	}
+}
+
+func TestDownloadPDFSkipsIndexedURLs(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	outputDir := t.TempDir()
+	indexPath := filepath.Join(outputDir, IndexFileName)
+	index, err := LoadIndex(indexPath)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	options.index = index
+	link := server.URL + "/files/a.pdf"
+	record, err := downloadPDF(context.Background(), options, link, outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	if err := index.Save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	// Archive the file, then start a new run with the saved index.
+	if err := os.Remove(filepath.Join(outputDir, record.Filename)); err != nil {
+		t.Fatal(err)
+	}
+	if options.index, err = LoadIndex(indexPath); err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("downloadPDF() of an indexed URL error = %v, want ErrAlreadyExists", err)
+	}
+	options.ignoreIndex = true
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Errorf("downloadPDF() with ignoreIndex error = %v", err)
+	}
+}
+
+func TestDownloadPDFChecksIndexedFilesAgainstChecksums(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.checksums = true
+	outputDir := t.TempDir()
+	index, err := LoadIndex(filepath.Join(outputDir, IndexFileName))
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	options.index = index
+	link := server.URL + "/files/a.pdf"
+	record, err := downloadPDF(context.Background(), options, link, outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+
+	// The index lists the URL, but the file still on disk no longer matches its sidecar.
+	filePath := filepath.Join(outputDir, record.Filename)
+	if err := os.WriteFile(filePath, []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Fatalf("downloadPDF() of a corrupted indexed file error = %v, want it downloaded again", err)
+	}
+	if data, _ := os.ReadFile(filePath); string(data) != testPDF+"/files/a.pdf" {
+		t.Errorf("file content = %q, want the downloaded PDF", data)
+	}
+}
+
+func TestDownloadPDFRefreshSendsStoredETag(t *testing.T) {
+	const etag = `"v1"`
+	var conditional atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	outputDir := t.TempDir()
+	indexPath := filepath.Join(outputDir, IndexFileName)
+	var err error
+	if options.index, err = LoadIndex(indexPath); err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	link := server.URL + "/a.pdf"
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	if err := options.index.Save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	// The next run revalidates the file with the ETag the index kept.
+	if options.index, err = LoadIndex(indexPath); err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if entry, _ := options.index.lookup(link); entry.ETag != etag {
+		t.Errorf("indexed ETag = %q, want %q", entry.ETag, etag)
+	}
+	options.refresh = true
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("downloadPDF() with refresh error = %v, want ErrAlreadyExists", err)
+	}
+	if conditional.Load() != 1 {
+		t.Error("refresh didn't send If-None-Match with the stored ETag")
+	}
+}
+
+func TestLoadDownloadIndexReadsBareHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IndexFileName)
+	if err := os.WriteFile(path, []byte(`{"https://ipcol.com/a.pdf": "abc123"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if entry, ok := index.lookup("https://ipcol.com/a.pdf"); !ok || entry.SHA256 != "abc123" {
+		t.Errorf("lookup() = %+v, %v, want the hash abc123", entry, ok)
+	}
+}
+
+// minimalPDF returns a structurally valid one page PDF with a correct cross-reference table.
+func minimalPDF() string {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>",
+	}
+	var document strings.Builder
+	document.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for index, object := range objects {
+		offsets[index] = document.Len()
+		fmt.Fprintf(&document, "%d 0 obj\n%s\nendobj\n", index+1, object)
+	}
+	xref := document.Len()
+	fmt.Fprintf(&document, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&document, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&document, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return document.String()
+}
+
+func TestDownloadPDFValidatesStructure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		if r.URL.Path == "/valid.pdf" {
+			io.WriteString(w, minimalPDF())
+			return
+		}
+		// Right signature, but no document structure behind it.
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.validatePDF = true
+
+	record, err := downloadPDF(context.Background(), options, server.URL+"/valid.pdf", t.TempDir())
+	if err != nil {
+		t.Fatalf("downloadPDF() of a valid PDF error = %v", err)
+	}
+	if record.Pages != 1 {
+		t.Errorf("record.Pages = %d, want 1", record.Pages)
+	}
+	outputDir := t.TempDir()
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/corrupt.pdf", outputDir); !errors.Is(err, errCorruptPDF) {
+		t.Errorf("downloadPDF() of a corrupt PDF error = %v, want errCorruptPDF", err)
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDownloadPDFStoresInSink(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.layout = LayoutHost
+	mirrorDir := t.TempDir()
+	options.sink = localSink{root: mirrorDir}
+
+	record, err := downloadPDF(context.Background(), options, server.URL+"/files/a.pdf", t.TempDir())
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	// The sink gets the file under the same relative name, shard directory included.
+	data, err := os.ReadFile(filepath.Join(mirrorDir, filepath.FromSlash(record.Filename)))
+	if err != nil {
+		t.Fatalf("reading stored file: %v", err)
+	}
+	if want := testPDF + "/files/a.pdf"; string(data) != want {
+		t.Errorf("stored content = %q, want %q", data, want)
+	}
+}
+
+func TestDownloadPDFRemovesFilesItCannotPublish(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.checksums = true
+	options.sink = diskFullSink{}
+	outputDir := t.TempDir()
+	link := server.URL + "/files/a.pdf"
+
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); !isDiskFull(err) {
+		t.Fatalf("downloadPDF() error = %v, want the sink's disk full error", err)
+	}
+	// Nothing may be left that would make the next run skip the link.
+	assertEmptyDir(t, outputDir)
+	options.sink = localSink{root: t.TempDir()}
+	if _, err := downloadPDF(context.Background(), options, link, outputDir); err != nil {
+		t.Errorf("downloadPDF() after the sink recovered error = %v", err)
+	}
+}
+
+func TestDownloadPDFSendsBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+
+	// Anonymous requests are turned away.
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/a.pdf", t.TempDir()); err == nil {
+		t.Fatal("downloadPDF() without credentials succeeded")
+	}
+	session := HTTPOptions{
+		Client:        server.Client(),
+		Authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret")),
+		AuthHosts:     []string{"127.0.0.1"},
+		IgnoreRobots:  true,
+	}
+	options.httpOptions = NewSession(session).options
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/a.pdf", t.TempDir()); err != nil {
+		t.Errorf("downloadPDF() with credentials error = %v", err)
+	}
+	// A link to another host never gets them.
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if _, err := downloadPDF(context.Background(), options, other+"/a.pdf", t.TempDir()); err == nil {
+		t.Error("downloadPDF() sent the credentials to a host other than the listing's")
+	}
+	session.AuthHosts = append(session.AuthHosts, "LOCALHOST")
+	options.httpOptions = NewSession(session).options
+	if _, err := downloadPDF(context.Background(), options, other+"/a.pdf", t.TempDir()); err != nil {
+		t.Errorf("downloadPDF() to another of the AuthHosts error = %v", err)
+	}
+}
+
+func TestDownloadPDFSendsCustomHeaders(t *testing.T) {
+	const referer = "https://ipcol.com/safety-data-sheets"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Referer() != referer {
+			http.Error(w, "hotlinking not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.headers = http.Header{"Referer": {referer}}
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/a.pdf", t.TempDir()); err != nil {
+		t.Errorf("downloadPDF() with a Referer header error = %v", err)
+	}
+}
+
+func TestDownloadPDFRunsPostCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the post-command with")
+	}
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	copied := filepath.Join(t.TempDir(), "copy.pdf")
+	// The file path arrives as the last argument, which sh -c names $0.
+	options.postCommand = []string{"sh", "-c", `cp "$0" ` + copied}
+
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/files/a.pdf", t.TempDir()); err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	if exists, _ := fileExists(osFileSystem{}, copied); !exists {
+		t.Error("post-command did not run on the saved file")
+	}
+
+	// A failing command is only logged.
+	options.postCommand = []string{"false"}
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/files/b.pdf", t.TempDir()); err != nil {
+		t.Errorf("downloadPDF() with a failing post-command error = %v", err)
+	}
+}
+
+func TestFlattenedNamesKeepsFullNamesOnCollision(t *testing.T) {
+	links := []string{
+		"https://ipcol.com/sds/Product-X.pdf",
+		"https://ipcol.com/en/sds.pdf",
+		"https://ipcol.com/fr/sds.pdf",
+	}
+	options := downloadOptions{flatNames: FlatNames(links)}
+	if got := options.filenameFor(links[0]); got != "product-x.pdf" {
+		t.Errorf("filenameFor(%q) = %q, want product-x.pdf", links[0], got)
+	}
+	// Both sds.pdf links fall back to the full URL based name.
+	for _, link := range links[1:] {
+		if got, want := options.filenameFor(link), extract.URLToFilename(link); got != want {
+			t.Errorf("filenameFor(%q) = %q, want %q", link, got, want)
+		}
+	}
+}
+
+func TestFilenameCollisions(t *testing.T) {
+	links := []string{
+		"https://ipcol.com/sds/a.pdf",
+		"https://ipcol.com/sds_a.pdf",
+		"https://ipcol.com/sds/b.pdf",
+	}
+	collisions := filenameCollisions(downloadOptions{}, links)
+	want := map[string][]string{extract.URLToFilename(links[0]): links[:2]}
+	if !reflect.DeepEqual(collisions, want) {
+		t.Errorf("filenameCollisions() = %q, want %q", collisions, want)
+	}
+	// A hash of the URL in every name keeps them apart.
+	if collisions := filenameCollisions(downloadOptions{hashNames: true}, links); len(collisions) != 0 {
+		t.Errorf("filenameCollisions() with hash names = %q, want none", collisions)
+	}
+}
+
+func TestDownloadPDFRetriesInterruptedTransfer(t *testing.T) {
+	// The first response promises more bytes than it sends; later ones are complete.
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		if requests.Add(1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testPDF)+100))
+		}
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	for _, test := range []struct {
+		attempts int
+		wantErr  bool
+	}{
+		{attempts: 1, wantErr: true},
+		{attempts: 2, wantErr: false},
+	} {
+		requests.Store(0)
+		options := testDownloadOptions(server)
+		options.maxAttempts = test.attempts
+		outputDir := t.TempDir()
+		_, err := downloadPDF(context.Background(), options, server.URL+"/doc.pdf", outputDir)
+		if test.wantErr {
+			if !errors.Is(err, errInterrupted) {
+				t.Errorf("%d attempts: downloadPDF() error = %v, want errInterrupted", test.attempts, err)
+			}
+			// A failed transfer must not leave a partial file behind.
+			assertEmptyDir(t, outputDir)
+		} else if err != nil {
+			t.Errorf("%d attempts: downloadPDF() error = %v, want success on retry", test.attempts, err)
+		}
+	}
+}
+
+func TestDownloadPDFResumesWithRange(t *testing.T) {
+	content := testPDF + strings.Repeat("x", 1000)
+	half := len(content) / 2
+	var ranges, ifRanges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"v1"`)
+		ranges = append(ranges, r.Header.Get("Range"))
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		if len(ranges) == 1 {
+			// Promise the whole file but stop halfway through.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			io.WriteString(w, content[:half])
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, content[half:])
+	}))
+	t.Cleanup(server.Close)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	options := testDownloadOptions(server)
+	options.maxAttempts = 2
+	outputDir := t.TempDir()
+	record, err := downloadPDF(context.Background(), options, server.URL+"/doc.pdf", outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	if want := []string{"", fmt.Sprintf("bytes=%d-", half)}; !slices.Equal(ranges, want) {
+		t.Errorf("Range headers = %q, want %q", ranges, want)
+	}
+	if want := []string{"", `"v1"`}; !slices.Equal(ifRanges, want) {
+		t.Errorf("If-Range headers = %q, want %q", ifRanges, want)
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, record.Filename))
+	if err != nil {
+		t.Fatalf("reading downloaded file: %v", err)
+	}
+	if string(data) != content || record.Size != int64(len(content)) {
+		t.Errorf("resumed file has %d bytes (record %d), want the original %d", len(data), record.Size, len(content))
+	}
+	if want, _ := fileSHA256(osFileSystem{}, filepath.Join(outputDir, record.Filename)); record.SHA256 != want {
+		t.Errorf("record.SHA256 = %s, want %s", record.SHA256, want)
+	}
+}
+
+// memFileSystem is a fileSystem kept in memory. It remembers which files were opened for
+// writing and every rename, so tests can check how a download reached its final name.
+type memFileSystem struct {
+	mutex   sync.Mutex
+	files   map[string][]byte
+	times   map[string]time.Time
+	written []string    // names opened for writing, in order
+	renames [][2]string // old and new name of every rename, in order
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: make(map[string][]byte), times: make(map[string]time.Time)}
+}
+
+func (files *memFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (file, error) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	_, exists := files.files[name]
+	if !exists && flag&os.O_CREATE == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if !exists || flag&os.O_TRUNC != 0 {
+		files.files[name] = nil
+		files.times[name] = time.Now()
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		files.written = append(files.written, name)
+	}
+	return &memFile{files: files, name: name, appending: flag&os.O_APPEND != 0}, nil
+}
+
+func (files *memFileSystem) Stat(name string) (fs.FileInfo, error) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	data, ok := files.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memFileInfo{name: filepath.Base(name), size: int64(len(data)), modTime: files.times[name]}, nil
+}
+
+func (files *memFileSystem) ReadFile(name string) ([]byte, error) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	data, ok := files.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(data), nil
+}
+
+func (files *memFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	files.files[name] = slices.Clone(data)
+	files.times[name] = time.Now()
+	files.written = append(files.written, name)
+	return nil
+}
+
+func (files *memFileSystem) Rename(oldPath, newPath string) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	data, ok := files.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	files.files[newPath], files.times[newPath] = data, files.times[oldPath]
+	delete(files.files, oldPath)
+	delete(files.times, oldPath)
+	files.renames = append(files.renames, [2]string{oldPath, newPath})
+	return nil
+}
+
+func (files *memFileSystem) Remove(name string) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if _, ok := files.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(files.files, name)
+	delete(files.times, name)
+	return nil
+}
+
+// Link copies oldName, which is as good as a hard link for files that are never changed in place.
+func (files *memFileSystem) Link(oldName, newName string) error {
+	data, err := files.ReadFile(oldName)
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(newName, data, 0o644)
+}
+
+func (files *memFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if _, ok := files.files[name]; !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	files.times[name] = mtime
+	return nil
+}
+
+func (files *memFileSystem) MkdirAll(string, fs.FileMode) error { return nil }
+
+// memFile is an open file of a memFileSystem.
+type memFile struct {
+	files     *memFileSystem
+	name      string
+	offset    int64
+	appending bool
+}
+
+func (opened *memFile) Read(buffer []byte) (int, error) {
+	n, err := opened.ReadAt(buffer, opened.offset)
+	opened.offset += int64(n)
+	return n, err
+}
+
+func (opened *memFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	opened.files.mutex.Lock()
+	defer opened.files.mutex.Unlock()
+	data := opened.files.files[opened.name]
+	if offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(buffer, data[offset:])
+	if n < len(buffer) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (opened *memFile) Write(buffer []byte) (int, error) {
+	opened.files.mutex.Lock()
+	defer opened.files.mutex.Unlock()
+	data := opened.files.files[opened.name]
+	if opened.appending {
+		opened.offset = int64(len(data))
+	}
+	data = append(data[:min(opened.offset, int64(len(data)))], buffer...)
+	opened.files.files[opened.name] = data
+	opened.offset += int64(len(buffer))
+	return len(buffer), nil
+}
+
+func (opened *memFile) Close() error { return nil }
+
+func (opened *memFile) Stat() (fs.FileInfo, error) { return opened.files.Stat(opened.name) }
+
+// memFileInfo describes a file of a memFileSystem.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info memFileInfo) Name() string { return info.name }
+
+func (info memFileInfo) Size() int64 { return info.size }
+
+func (info memFileInfo) Mode() fs.FileMode { return 0o644 }
+
+func (info memFileInfo) ModTime() time.Time { return info.modTime }
+
+func (info memFileInfo) IsDir() bool { return false }
+
+func (info memFileInfo) Sys() any { return nil }
+
+func TestDownloadPDFWritesThroughFileSystem(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.checksums = true
+	files := newMemFileSystem()
+	options.files = files
+	outputDir := filepath.Join(t.TempDir(), "out")
+
+	record, err := downloadPDF(context.Background(), options, server.URL+"/files/a.pdf", outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	filePath := filepath.Join(outputDir, record.Filename)
+	if got, want := string(files.files[filePath]), testPDF+"/files/a.pdf"; got != want {
+		t.Errorf("saved content = %q, want %q", got, want)
+	}
+	// The body only ever went into the partial file, which was renamed into place once complete.
+	if want := []string{filePath + ".part", filePath + checksumSuffix}; !slices.Equal(files.written, want) {
+		t.Errorf("files written = %q, want %q", files.written, want)
+	}
+	if want := [][2]string{{filePath + ".part", filePath}}; !reflect.DeepEqual(files.renames, want) {
+		t.Errorf("renames = %q, want %q", files.renames, want)
+	}
+	if _, ok := files.files[filePath+".part"]; ok {
+		t.Error("temporary .part file left behind")
+	}
+	if _, err := os.Stat(outputDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("output directory on disk: %v, want nothing written to disk", err)
+	}
+
+	// The second download finds the file, and its checksum, in the same filesystem.
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/files/a.pdf", outputDir); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("second downloadPDF() error = %v, want ErrAlreadyExists", err)
+	}
+}
+
+func TestDownloadPDFRestartsWhenDocumentChangedWhileResuming(t *testing.T) {
+	revisions := []string{testPDF + strings.Repeat("1", 1000), testPDF + strings.Repeat("2", 1000)}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Accept-Ranges", "bytes")
+		if requests.Add(1) == 1 {
+			// Promise the whole first revision but stop halfway through.
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(revisions[0])))
+			io.WriteString(w, revisions[0][:len(revisions[0])/2])
+			return
+		}
+		// The document changed since. A range request without a matching If-Range gets the rest
+		// of the new revision, which doesn't fit the start of the old one.
+		w.Header().Set("ETag", `"v2"`)
+		if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && r.Header.Get("If-Range") != `"v1"` {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(start, "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(revisions[1])-1, len(revisions[1])))
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, revisions[1][offset:])
+			return
+		}
+		io.WriteString(w, revisions[1])
+	}))
+	t.Cleanup(server.Close)
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	options := testDownloadOptions(server)
+	options.maxAttempts = 2
+	outputDir := t.TempDir()
+	record, err := downloadPDF(context.Background(), options, server.URL+"/doc.pdf", outputDir)
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, record.Filename))
+	if err != nil {
+		t.Fatalf("reading downloaded file: %v", err)
+	}
+	if string(data) != revisions[1] {
+		t.Errorf("saved %d bytes mixing revisions, want the whole new revision", len(data))
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, record.Filename) + ".part" + validatorSuffix); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("validator of the partial file left behind: %v", err)
+	}
+}
+
+func TestDownloadPDFUnparseableURL(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+	_, err := downloadPDF(context.Background(), testDownloadOptions(server), "http://[::1/files/a.pdf", outputDir)
+	if !errors.Is(err, errNoFilename) {
+		t.Errorf("downloadPDF() error = %v, want errNoFilename", err)
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDownloadPDFRejectsNonPDFContentType(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+	_, err := downloadPDF(context.Background(), testDownloadOptions(server), server.URL+"/files/page.pdf", outputDir)
+	if err == nil || !strings.Contains(err.Error(), "invalid content type") {
+		t.Errorf("downloadPDF() error = %v, want an invalid content type error", err)
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDownloadPDFSniffsMissingContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A nil value stops the server from filling in a sniffed Content-Type itself.
+		w.Header()["Content-Type"] = nil
+		if r.URL.Path == "/image.pdf" {
+			io.WriteString(w, "\x89PNG\r\n\x1a\n")
+			return
+		}
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/a.pdf", t.TempDir()); err != nil {
+		t.Errorf("downloadPDF() without a content type error = %v", err)
+	}
+	outputDir := t.TempDir()
+	if _, err := downloadPDF(context.Background(), options, server.URL+"/image.pdf", outputDir); err == nil {
+		t.Error("downloadPDF() accepted a PNG without a content type")
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDownloadPDFRejectsSoft404(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, "\n  <!DOCTYPE html><html><body>Not Found</body></html>")
+	}))
+	t.Cleanup(server.Close)
+	outputDir := t.TempDir()
+	_, err := downloadPDF(context.Background(), testDownloadOptions(server), server.URL+"/missing.pdf", outputDir)
+	if !errors.Is(err, ErrSoft404) {
+		t.Errorf("downloadPDF() error = %v, want ErrSoft404", err)
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDownloadPDFNotFound(t *testing.T) {
+	server := newTestServer(t)
+	outputDir := t.TempDir()
+	record, err := downloadPDF(context.Background(), testDownloadOptions(server), server.URL+"/files/missing.pdf", outputDir)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("downloadPDF() error = %v, want a 404 error", err)
+	}
+	if record.StatusCode != http.StatusNotFound {
+		t.Errorf("record.StatusCode = %d, want %d", record.StatusCode, http.StatusNotFound)
+	}
+	assertEmptyDir(t, outputDir)
+}
+
+func TestDoWithRetryRetriesServerErrors(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = 10 * time.Millisecond
+	tests := []struct {
+		name         string
+		statuses     []int // answered in turn, the last one from then on
+		wantStatus   int   // status handed back; 0 means an error
+		wantAttempts int32
+	}{
+		{"server error then success", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, http.StatusOK, 3},
+		{"server errors until giving up", []int{http.StatusInternalServerError}, 0, 3},
+		{"client error returned at once", []int{http.StatusNotFound}, http.StatusNotFound, 1},
+		{"rate limited returned at once", []int{http.StatusTooManyRequests}, http.StatusTooManyRequests, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := int(attempts.Add(1))
+				w.WriteHeader(test.statuses[min(attempt, len(test.statuses))-1])
+			}))
+			t.Cleanup(server.Close)
+			options := testDownloadOptions(server).httpOptions
+			options.maxAttempts = 3
+			request, err := options.newRequest(context.Background(), http.MethodGet, server.URL+"/a.pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			started := time.Now()
+			response, err := options.doWithRetry(request)
+			elapsed := time.Since(started)
+			if response != nil {
+				response.Body.Close()
+			}
+			switch {
+			case test.wantStatus == 0 && err == nil:
+				t.Errorf("doWithRetry() = %s, want an error", response.Status)
+			case test.wantStatus != 0 && (err != nil || response.StatusCode != test.wantStatus):
+				t.Errorf("doWithRetry() = %v, %v, want status %d", response, err, test.wantStatus)
+			}
+			if got := attempts.Load(); got != test.wantAttempts {
+				t.Errorf("server saw %d attempts, want %d", got, test.wantAttempts)
+			}
+			// The retries back off: 10ms before the second attempt, 20ms before the third.
+			if test.wantAttempts == 3 && elapsed < 30*time.Millisecond {
+				t.Errorf("three attempts took %v, want at least 30ms of backoff", elapsed)
+			}
+		})
+	}
+}
+
+func TestDownloadPDFSizeLimits(t *testing.T) {
+	const body = testPDF + "sized document"
+	size := int64(len(body))
+	tests := []struct {
+		name             string
+		maxSize, minSize int64
+		wantErr          string // part of the error; empty means the download succeeds
+	}{
+		{"exactly the maximum", size, 0, ""},
+		{"one byte over the maximum", size - 1, 0, errTooLarge.Error()},
+		{"exactly the minimum", 0, size, ""},
+		{"one byte under the minimum", 0, size + 1, "suspiciously small"},
+	}
+	for _, chunked := range []bool{false, true} {
+		// Without a Content-Length the limits can only be checked on the bytes that arrive.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/pdf")
+			if chunked {
+				w.(http.Flusher).Flush()
+			}
+			io.WriteString(w, body)
+		}))
+		t.Cleanup(server.Close)
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s chunked=%v", test.name, chunked), func(t *testing.T) {
+				options := testDownloadOptions(server)
+				options.maxSize, options.minSize = test.maxSize, test.minSize
+				outputDir := t.TempDir()
+
+				record, err := downloadPDF(context.Background(), options, server.URL+"/doc.pdf", outputDir)
+				if test.wantErr == "" {
+					if err != nil || record.Size != size {
+						t.Errorf("downloadPDF() = size %d, %v, want %d bytes saved", record.Size, err, size)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("downloadPDF() error = %v, want one mentioning %q", err, test.wantErr)
+				}
+				if test.maxSize > 0 && !IsSkip(err) {
+					t.Errorf("IsSkip(%v) = false, want oversized files skipped", err)
+				}
+				assertEmptyDir(t, outputDir)
+			})
+		}
+	}
+}
+
+func TestIsTooManyOpenFiles(t *testing.T) {
+	openErr := fmt.Errorf("download x: %w", &fs.PathError{Op: "open", Path: "x.pdf.part", Err: syscall.EMFILE})
+	if !isTooManyOpenFiles(openErr) {
+		t.Errorf("isTooManyOpenFiles(%v) = false, want true", openErr)
+	}
+	dialErr := fmt.Errorf("giving up: %w", &net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.EMFILE)})
+	if !isTooManyOpenFiles(dialErr) {
+		t.Errorf("isTooManyOpenFiles(%v) = false, want true", dialErr)
+	}
+	if isTooManyOpenFiles(errInterrupted) {
+		t.Error("isTooManyOpenFiles(errInterrupted) = true, want false")
+	}
+}
+
+func TestDownloadPDFNamesExtensionlessDocumentsByContentType(t *testing.T) {
+	const xlsxType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", xlsxType)
+		io.WriteString(w, "PK\x03\x04 spreadsheet")
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.anyDocument = true
+
+	record, err := downloadPDF(context.Background(), options, server.URL+"/download?id=7", t.TempDir())
+	if err != nil {
+		t.Fatalf("downloadPDF() error = %v", err)
+	}
+	if !strings.HasSuffix(record.Filename, ".xlsx") {
+		t.Errorf("Filename = %q, want an .xlsx extension from %s", record.Filename, xlsxType)
+	}
+}
+
+func TestExtensionForType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"application/pdf", ".pdf"},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet; charset=binary", ".xlsx"},
+		{"Application/MSWord", ".doc"},
+		{"application/octet-stream", ""},
+		{"not a type", ""},
+	}
+	for _, test := range tests {
+		if got := extensionForType(test.contentType); got != test.want {
+			t.Errorf("extensionForType(%q) = %q, want %q", test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestWaitJitter(t *testing.T) {
+	started := time.Now()
+	if err := waitJitter(context.Background(), 20*time.Millisecond); err != nil {
+		t.Fatalf("waitJitter() error = %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("waitJitter() took %s, want at most about 20ms", elapsed)
+	}
+	// A cancelled run doesn't sit out the delay.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitJitter(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitJitter() after cancel error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRobotsRules(t *testing.T) {
+	const userAgent = "ipcol-doc-scraper/1.0"
+	tests := []struct {
+		name   string
+		robots string
+		path   string
+		want   bool
+	}{
+		{"no rules", "", "/sds/a.pdf", true},
+		{"disallowed prefix", "User-agent: *\nDisallow: /sds/", "/sds/a.pdf", false},
+		{"other prefix", "User-agent: *\nDisallow: /private/", "/sds/a.pdf", true},
+		{"longest match wins", "User-agent: *\nDisallow: /sds/\nAllow: /sds/public/", "/sds/public/a.pdf", true},
+		{"longer disallow beats allow", "User-agent: *\nAllow: /sds/\nDisallow: /sds/private/", "/sds/private/a.pdf", false},
+		{"allow wins ties", "User-agent: *\nDisallow: /sds\nAllow: /sds", "/sds/a.pdf", true},
+		{"wildcard", "User-agent: *\nDisallow: /*.pdf", "/sds/a.pdf", false},
+		{"end anchor", "User-agent: *\nDisallow: /*.pdf$", "/sds/a.pdf?download=1", true},
+		{"end anchor matches", "User-agent: *\nDisallow: /*.pdf$", "/sds/a.pdf", false},
+		{"query counts", "User-agent: *\nDisallow: /*?download=", "/sds/a.pdf?download=1", false},
+		{"comments ignored", "User-agent: * # everyone\nDisallow: /sds/ # no documents", "/sds/a.pdf", false},
+		{"named group wins", "User-agent: *\nDisallow: /\n\nUser-agent: ipcol-doc-scraper\nDisallow: /private/", "/sds/a.pdf", true},
+		{"named group allowing everything", "User-agent: *\nDisallow: /\n\nUser-agent: IPCOL-DOC-SCRAPER\nDisallow:", "/sds/a.pdf", true},
+		{"other agent's group", "User-agent: otherbot\nDisallow: /", "/sds/a.pdf", true},
+		{"shared group", "User-agent: otherbot\nUser-agent: ipcol-doc-scraper\nDisallow: /sds/", "/sds/a.pdf", false},
+		{"empty agent matches nobody", "User-agent:\nDisallow: /", "/sds/a.pdf", true},
+		{"empty agent keeps the fallback", "User-agent: *\nDisallow: /sds/\n\nUser-agent:\nAllow: /", "/sds/a.pdf", false},
+		{"part of our name", "User-agent: ipcol\nDisallow: /", "/sds/a.pdf", true},
+		{"longer name", "User-agent: ipcol-doc-scraper-bot\nDisallow: /", "/sds/a.pdf", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := parseRobots(strings.NewReader(test.robots), userAgent)
+			if got := rules.allowed(test.path); got != test.want {
+				t.Errorf("allowed(%q) = %v, want %v", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRobotsCheckerFetchesLikeOtherRequests(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "User-agent: *\nDisallow: /private/")
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server).httpOptions
+	options.headers = http.Header{"X-Token": {"secret"}}
+	checker := newRobotsChecker(options)
+
+	// A lookup cancelled before robots.txt arrives lets the URL through but isn't remembered.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !checker.allowed(cancelled, server.URL+"/private/a.pdf") {
+		t.Error("allowed() with a cancelled context = false, want true")
+	}
+	for range 2 {
+		if checker.allowed(context.Background(), server.URL+"/private/a.pdf") {
+			t.Error("allowed() = true, want false once robots.txt was read with the -header values")
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("server saw %d robots.txt requests, want 1", got)
+	}
+}
+
+func TestDownloadStreamStopsAtMaxFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	outputDir := t.TempDir()
+	options := testDownloadOptions(server)
+	// One file is already present and one is missing; neither counts toward the cap.
+	present := server.URL + "/present.pdf"
+	if err := os.WriteFile(filepath.Join(outputDir, options.filenameFor(present)), []byte(testPDF), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := []string{present, server.URL + "/missing.pdf"}
+	for index := range 10 {
+		links = append(links, fmt.Sprintf("%s/%d.pdf", server.URL, index))
+	}
+	options.maxFiles = 3
+
+	results := collectResults(downloadStream(context.Background(), options, links, outputDir, 4))
+	if got := len(successfulRecords(results)); got != 3 {
+		t.Errorf("got %d successful downloads, want 3", got)
+	}
+	for _, result := range results {
+		if errors.Is(result.Err, context.Canceled) {
+			t.Errorf("download of %s was cut off: %v", result.Record.URL, result.Err)
+		}
+	}
+}
+
+func TestDownloadStreamDeliversResultsAsTheyFinish(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.pdf" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	links := []string{server.URL + "/slow.pdf", server.URL + "/fast.pdf"}
+
+	stream := downloadStream(context.Background(), testDownloadOptions(server), links, t.TempDir(), 2)
+	// The fast download arrives while the slow one is still held up by the server.
+	first := <-stream
+	if first.Err != nil || first.Record.URL != links[1] {
+		t.Errorf("first result = %s (%v), want %s", first.Record.URL, first.Err, links[1])
+	}
+	close(release)
+	second, ok := <-stream
+	if !ok || second.Err != nil || second.Record.URL != links[0] {
+		t.Errorf("second result = %s (%v), want %s", second.Record.URL, second.Err, links[0])
+	}
+	if _, ok := <-stream; ok {
+		t.Error("stream still open after every link was processed")
+	}
+}
+
+func TestDownloadPDFCollapsesConcurrentDownloadsOfOneFile(t *testing.T) {
+	var hits atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.inFlight = &singleflight.Group{}
+	outputDir := t.TempDir()
+	link := server.URL + "/a.pdf"
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := downloadPDF(context.Background(), options, link, outputDir)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err := downloadPDF(context.Background(), options, link, outputDir)
+		errs <- err
+	}()
+	// Give the second download time to find the first one under way.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	var downloaded, skipped int
+	for range 2 {
+		switch err := <-errs; {
+		case err == nil:
+			downloaded++
+		case errors.Is(err, ErrAlreadyExists):
+			skipped++
+		default:
+			t.Errorf("downloadPDF() error = %v", err)
+		}
+	}
+	if downloaded != 1 || skipped != 1 {
+		t.Errorf("got %d downloaded and %d skipped, want one of each", downloaded, skipped)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("server was hit %d times, want 1", got)
+	}
+}
+
+func TestDownloadStreamFinishesDownloadsInFlightOnCancel(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.pdf" {
+			close(started)
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.grace = time.Minute
+	// Publishing is part of finishing, so it must not see the cancellation either.
+	options.sink = contextSink{localSink{root: t.TempDir()}}
+	links := []string{server.URL + "/slow.pdf", server.URL + "/next.pdf"}
+
+	// Cancel while the first download is under way, as Ctrl-C would.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+		close(release)
+	}()
+	results := collectResults(downloadStream(ctx, options, links, t.TempDir(), 1))
+	if len(results) != 1 || results[0].Err != nil || results[0].Record.URL != links[0] {
+		t.Fatalf("results = %+v, want only the download in flight, finished", results)
+	}
+}
+
+// contextSink is a Sink that refuses to store anything once its context is done.
+type contextSink struct {
+	Sink
+}
+
+func (sink contextSink) Store(ctx context.Context, name string, data io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sink.Sink.Store(ctx, name, data)
+}
+
+// diskFullSink is a Sink on a disk without space left.
+type diskFullSink struct{}
+
+func (diskFullSink) Store(context.Context, string, io.Reader) error {
+	return &fs.PathError{Op: "write", Path: "sink", Err: syscall.ENOSPC}
+}
+
+func TestDownloadStreamStopsWhenDiskIsFull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, testPDF+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	options := testDownloadOptions(server)
+	options.sink = diskFullSink{}
+	var links []string
+	for index := range 10 {
+		links = append(links, fmt.Sprintf("%s/%d.pdf", server.URL, index))
+	}
+
+	results := collectResults(downloadStream(context.Background(), options, links, t.TempDir(), 1))
+	if len(results) == 0 || !isDiskFull(results[0].Err) {
+		t.Fatalf("results = %+v, want a disk full failure first", results)
+	}
+	if len(results) > 2 {
+		t.Errorf("got %d results, want the run to stop after the disk filled up", len(results))
+	}
+}
+
+func TestDownloadStreamSkipsClaimedURLs(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	options.claimed = &URLSet{}
+	// The second link is the first one with a fragment, so both name the same document.
+	links := []string{server.URL + "/files/a.pdf", server.URL + "/files/a.pdf#page=2"}
+	results := collectResults(downloadStream(context.Background(), options, links, t.TempDir(), 2))
+	var duplicates int
+	for _, result := range results {
+		if errors.Is(result.Err, errDuplicateURL) {
+			duplicates++
+		}
+	}
+	if duplicates != 1 || len(successfulRecords(results)) != 1 {
+		t.Errorf("got %d duplicates and %d downloads, want 1 of each", duplicates, len(successfulRecords(results)))
+	}
+	if got := options.claimed.Snapshot(); len(got) != 1 || !options.claimed.Contains(links[1]) {
+		t.Errorf("claimed = %v, want one of the two links", got)
+	}
+}
+
+func TestDownloadSharesClaimedURLsWithTheCrawl(t *testing.T) {
+	server := newTestServer(t)
+	t.Chdir(t.TempDir())
+	claimed := &URLSet{}
+	options := Options{Session: &Session{options: testDownloadOptions(server).httpOptions}, Claimed: claimed}
+	link := server.URL + "/files/a.pdf"
+
+	// A second Download sharing the set skips the link the first one handled.
+	for attempt, wantErr := range []error{nil, errDuplicateURL} {
+		results := collectResults(Download(context.Background(), []string{link}, t.TempDir(), options))
+		if len(results) != 1 || !errors.Is(results[0].Err, wantErr) {
+			t.Fatalf("Download() #%d = %+v, want error %v", attempt+1, results, wantErr)
+		}
+	}
+	// So does a crawl consulting it, while its other links still come through.
+	links, err := options.Session.CollectLinks(context.Background(), Crawl{MaxPages: 1, Claimed: claimed}, []string{server.URL + "/sds"})
+	if want := []string{server.URL + "/files/b.pdf"}; err != nil || !slices.Equal(links, want) {
+		t.Errorf("CollectLinks() = %q, %v, want %q", links, err, want)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for index := range 20 {
+		filePath := filepath.Join(dir, fmt.Sprintf("%02d.pdf", index))
+		content := testPDF + strconv.Itoa(index)
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := fileSHA256(osFileSystem{}, filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeChecksumFile(osFileSystem{}, filePath, hash); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filePath)
+	}
+	// One file changed since its checksum was written, one is gone and one never had a checksum.
+	if err := os.WriteFile(paths[3], []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(paths[7]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "unchecked.pdf"), []byte(testPDF), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, problems, err := Verify(context.Background(), dir, 4)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	want := []ChecksumProblem{{Path: paths[3], Reason: "mismatch"}, {Path: paths[7], Reason: "missing"}}
+	if checked != 20 || !reflect.DeepEqual(problems, want) {
+		t.Errorf("Verify() = %d, %+v, want 20, %+v", checked, problems, want)
+	}
+}
+
+func TestManifestRecordsListFilesAlreadyPresent(t *testing.T) {
+	server := newTestServer(t)
+	options := testDownloadOptions(server)
+	outputDir := t.TempDir()
+	index, err := LoadIndex(filepath.Join(outputDir, IndexFileName))
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	options.index = index
+	links := []string{server.URL + "/files/a.pdf", server.URL + "/files/b.pdf"}
+	first := ManifestRecords(collectResults(downloadStream(context.Background(), options, links, outputDir, 1)), index, outputDir)
+
+	// The next run skips both files, and archiving one doesn't drop it from the manifest.
+	if err := os.Remove(filepath.Join(outputDir, first[0].Filename)); err != nil {
+		t.Fatal(err)
+	}
+	second := ManifestRecords(collectResults(downloadStream(context.Background(), options, links, outputDir, 1)), index, outputDir)
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("manifests list %d and %d files, want 2 each", len(first), len(second))
+	}
+	for position := range first {
+		if first[position].URL != second[position].URL || first[position].SHA256 != second[position].SHA256 {
+			t.Errorf("second run lists %s (%s), want %s (%s) as in the first", second[position].URL, second[position].SHA256, first[position].URL, first[position].SHA256)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// fileSystem is what the download path needs from the disk. Runs use osFileSystem; tests
+// swap in one kept in memory to check exactly what was written, and under which name,
+// without touching the disk. Paths are OS paths, as for the os package.
+type fileSystem interface {
+	// OpenFile opens name with the os.O_* flags in flag, creating it with perm if asked to.
+	OpenFile(name string, flag int, perm fs.FileMode) (file, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// Rename moves oldPath to newPath, replacing newPath. Downloads rely on it being atomic.
+	Rename(oldPath, newPath string) error
+	Remove(name string) error
+	// Link makes newName a hard link to oldName.
+	Link(oldName, newName string) error
+	Chtimes(name string, atime, mtime time.Time) error
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// file is an open file of a fileSystem. *os.File satisfies it.
+type file interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// osFileSystem is the fileSystem of the real disk.
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (file, error) {
+	// Return a nil interface, not a nil *os.File, when opening fails.
+	opened, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return opened, nil
+}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+func (osFileSystem) ReadFile(name string) ([]byte, error)  { return os.ReadFile(name) }
+func (osFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (osFileSystem) Rename(oldPath, newPath string) error         { return os.Rename(oldPath, newPath) }
+func (osFileSystem) Remove(name string) error                     { return os.Remove(name) }
+func (osFileSystem) Link(oldName, newName string) error           { return os.Link(oldName, newName) }
+func (osFileSystem) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// openFile opens name in files for reading.
+func openFile(files fileSystem, name string) (file, error) {
+	return files.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// createFile creates or truncates name in files for writing.
+func createFile(files fileSystem, name string) (file, error) {
+	return files.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+// fileExists reports whether name is a file in files. When it can't tell, such as on a
+// permission error, it returns the error rather than reporting the file as missing.
+func fileExists(files fileSystem, name string) (bool, error) {
+	info, err := files.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the file name in files.
+func fileSHA256(files fileSystem, name string) (string, error) {
+	opened, err := openFile(files, name)
+	if err != nil {
+		return "", err
+	}
+	defer opened.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, opened); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,74 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testPDF is a minimal body that passes the PDF signature check.
+const testPDF = "%PDF-1.4\n% test document\n%%EOF\n"
+
+// newTestServer serves a listing page linking to two PDFs, an HTML page posing as a
+// document, and a missing file.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sds", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body>
+<a href="/files/a.pdf">A</a>
+<a href="/files/b.pdf">B</a>
+<a href="/files/a.pdf">A again</a>
+<a href="/about.html">About</a>
+</body></html>`)
+	})
+	for _, name := range []string{"/files/a.pdf", "/files/b.pdf"} {
+		mux.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/pdf")
+			fmt.Fprint(w, testPDF+name)
+		})
+	}
+	mux.HandleFunc("/files/page.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>not a pdf</html>")
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testDownloadOptions returns options that talk to server without retries or robots.txt checks.
+func testDownloadOptions(server *httptest.Server) downloadOptions {
+	return downloadOptions{
+		httpOptions: httpOptions{
+			client:      server.Client(),
+			userAgent:   DefaultUserAgent,
+			maxAttempts: 1,
+		},
+		contentHashes: newContentIndex(),
+	}
+}
+
+// collectResults drains stream and returns the results in the order they arrived.
+func collectResults(stream <-chan Result) []Result {
+	var results []Result
+	for result := range stream {
+		results = append(results, result)
+	}
+	return results
+}
+
+// assertEmptyDir fails the test if dir contains any entries.
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected %s to be empty, found %d entries", dir, len(entries))
+	}
+}
@@ -0,0 +1,110 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/fsutil"
+)
+
+// IndexFileName is the name of the persistent download index in the output directory.
+const IndexFileName = ".downloaded.json"
+
+// Index remembers every URL ever downloaded into an output directory, with the SHA-256 of
+// what was saved, so a file moved away to an archive isn't fetched again. It is safe for
+// concurrent use.
+type Index struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]indexEntry // keyed by URL
+}
+
+// indexEntry is what the index knows about one downloaded URL. The validators let -refresh
+// ask the server whether the file changed with If-None-Match and If-Modified-Since.
+type indexEntry struct {
+	SHA256       string    `json:"sha256"`                 // hex encoded SHA-256 of the content
+	ETag         string    `json:"etag,omitempty"`         // ETag header of the response
+	LastModified time.Time `json:"last_modified,omitzero"` // Last-Modified header of the response
+}
+
+// UnmarshalJSON also accepts the bare hash older indexes stored for each URL.
+func (entry *indexEntry) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &entry.SHA256); err == nil {
+		return nil
+	}
+	type plain indexEntry
+	return json.Unmarshal(data, (*plain)(entry))
+}
+
+// LoadIndex reads the index at path. A missing file is an empty index.
+func LoadIndex(path string) (*Index, error) {
+	index := &Index{path: path, entries: make(map[string]indexEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read download index %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &index.entries); err != nil {
+		return nil, fmt.Errorf("read download index %s: %w", path, err)
+	}
+	if index.entries == nil {
+		index.entries = make(map[string]indexEntry)
+	}
+	return index, nil
+}
+
+// contains reports whether uri was downloaded in this or an earlier run. A nil index is empty.
+func (index *Index) contains(uri string) bool {
+	if index == nil {
+		return false
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	_, ok := index.entries[uri]
+	return ok
+}
+
+// lookup returns what the index knows about uri, and whether it has an entry. A nil index is empty.
+func (index *Index) lookup(uri string) (indexEntry, bool) {
+	if index == nil {
+		return indexEntry{}, false
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	entry, ok := index.entries[uri]
+	return entry, ok
+}
+
+// add records that uri was downloaded as described by record. A nil index records nothing.
+func (index *Index) add(uri string, record Record) {
+	if index == nil {
+		return
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.entries[uri] = indexEntry{SHA256: record.SHA256, ETag: record.ETag, LastModified: record.LastModified}
+}
+
+// Save writes the index back to its file, replacing it atomically so an interrupted run
+// can't leave it half written. A nil index has nothing to save.
+func (index *Index) Save() error {
+	if index == nil {
+		return nil
+	}
+	index.mutex.Lock()
+	data, err := json.MarshalIndent(index.entries, "", "  ")
+	index.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("write download index %s: %w", index.path, err)
+	}
+	if err := fsutil.WriteFileAtomic(index.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("write download index: %w", err)
+	}
+	return nil
+}
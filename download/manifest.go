@@ -0,0 +1,88 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestFileName is the name of the manifest written into the output directory.
+const ManifestFileName = "manifest.json"
+
+// Record describes a PDF saved during a run.
+type Record struct {
+	URL          string    `json:"url"`                    // source URL of the PDF
+	ResolvedURL  string    `json:"resolved_url,omitempty"` // URL the redirects ended at, when different
+	Filename     string    `json:"filename"`               // file name inside the output directory
+	Size         int64     `json:"size"`                   // size in bytes
+	SHA256       string    `json:"sha256"`                 // hex encoded SHA-256 of the content
+	DownloadedAt time.Time `json:"downloaded_at"`          // when the download finished
+	StatusCode   int       `json:"status_code"`            // HTTP status of the response
+	ContentType  string    `json:"content_type"`           // Content-Type header of the response
+	ETag         string    `json:"etag,omitempty"`         // ETag header of the response
+	LastModified time.Time `json:"last_modified,omitzero"` // Last-Modified header of the response
+	Pages        int       `json:"pages,omitempty"`        // page count, when checked with Options.ValidatePDF
+	Extracted    []string  `json:"extracted,omitempty"`    // PDFs unpacked from a ZIP archive with Options.ExtractZips
+}
+
+// successfulRecords returns the records of the downloads that succeeded.
+func successfulRecords(results []Result) []Record {
+	var records []Record
+	for _, result := range results {
+		if result.Err == nil {
+			records = append(records, result.Record)
+		}
+	}
+	return records
+}
+
+// ManifestRecords returns what the manifest lists: the downloads that succeeded and the
+// files skipped because they were already saved, so that the manifests of two runs can be
+// compared even when the second one downloaded nothing new. A skipped file gets the hash the index recorded for
+// it, or else the hash of the file itself; one with neither is left out.
+func ManifestRecords(results []Result, index *Index, outputDir string) []Record {
+	var records []Record
+	for _, result := range results {
+		record := result.Record
+		switch {
+		case result.Err == nil:
+		case errors.Is(result.Err, ErrAlreadyExists):
+			if entry, ok := index.lookup(record.URL); ok && entry.SHA256 != "" {
+				record.SHA256, record.ETag, record.LastModified = entry.SHA256, entry.ETag, entry.LastModified
+			} else if record.Filename != "" {
+				record.SHA256, _ = fileSHA256(osFileSystem{}, filepath.Join(outputDir, filepath.FromSlash(record.Filename)))
+			}
+			if record.Filename != "" {
+				if info, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(record.Filename))); err == nil {
+					record.Size = info.Size()
+				}
+			}
+			if record.SHA256 == "" {
+				continue
+			}
+		default:
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// WriteManifest saves entries as indented JSON at path.
+func WriteManifest(path string, entries []Record) error {
+	// Write an empty list rather than null when nothing was downloaded.
+	if entries == nil {
+		entries = []Record{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write manifest %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write manifest %s: %w", path, err)
+	}
+	return nil
+}
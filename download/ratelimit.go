@@ -0,0 +1,167 @@
+package download
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// hostRateLimiter spaces out requests so no host receives more than the configured rate.
+// Every worker shares one limiter per host. It is safe for concurrent use.
+type hostRateLimiter struct {
+	limit    rate.Limit
+	mutex    sync.Mutex
+	limiters map[string]*rate.Limiter // keyed by host
+}
+
+// newHostRateLimiter returns a limiter allowing requestsPerSecond requests to each host.
+// A rate of zero or less disables limiting.
+func newHostRateLimiter(requestsPerSecond float64) *hostRateLimiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	return &hostRateLimiter{
+		limit:    rate.Limit(requestsPerSecond),
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// wait blocks until a request to uri's host is allowed or ctx is done.
+// A nil limiter never blocks.
+func (limiter *hostRateLimiter) wait(ctx context.Context, uri string) error {
+	if limiter == nil {
+		return nil
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	return limiter.forHost(parsed.Host).Wait(ctx)
+}
+
+// forHost returns the limiter for host, creating it on first use.
+func (limiter *hostRateLimiter) forHost(host string) *rate.Limiter {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	hostLimiter, ok := limiter.limiters[host]
+	if !ok {
+		hostLimiter = rate.NewLimiter(limiter.limit, 1)
+		limiter.limiters[host] = hostLimiter
+	}
+	return hostLimiter
+}
+
+// waitJitter sleeps for a random time up to maximum, so requests don't go out at a perfectly
+// regular pace, returning early with the context's error if ctx is done meanwhile. The global
+// math/rand/v2 source is seeded afresh for every run, so the pattern differs between runs.
+func waitJitter(ctx context.Context, maximum time.Duration) error {
+	if maximum <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(rand.N(maximum + 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostSemaphore caps how many requests may be in flight to each host at once,
+// independently of the overall worker count. It is safe for concurrent use.
+type hostSemaphore struct {
+	perHost int
+	mutex   sync.Mutex
+	slots   map[string]chan struct{} // keyed by host; each buffered to perHost
+}
+
+// newHostSemaphore returns a semaphore allowing perHost concurrent requests to each host.
+// A limit of zero or less disables the cap.
+func newHostSemaphore(perHost int) *hostSemaphore {
+	if perHost <= 0 {
+		return nil
+	}
+	return &hostSemaphore{
+		perHost: perHost,
+		slots:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a slot for uri's host is free or ctx is done. On success the
+// returned function must be called to give the slot back. A nil semaphore never blocks.
+func (semaphore *hostSemaphore) acquire(ctx context.Context, uri string) (func(), error) {
+	if semaphore == nil {
+		return func() {}, nil
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return func() {}, nil
+	}
+	slots := semaphore.forHost(parsed.Host)
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// forHost returns the slots for host, creating them on first use.
+func (semaphore *hostSemaphore) forHost(host string) chan struct{} {
+	semaphore.mutex.Lock()
+	defer semaphore.mutex.Unlock()
+	slots, ok := semaphore.slots[host]
+	if !ok {
+		slots = make(chan struct{}, semaphore.perHost)
+		semaphore.slots[host] = slots
+	}
+	return slots
+}
+
+// maxBandwidthBurst is the most bytes a throttled reader hands out in one Read, keeping
+// the flow smooth instead of bursty.
+const maxBandwidthBurst = 32 * 1024
+
+// newBandwidthLimiter returns a token bucket allowing bytesPerSecond bytes per second,
+// shared by every download so their total stays within it. A limit of zero or less disables it.
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxBandwidthBurst)))
+}
+
+// throttledReader reads from reader no faster than limiter allows.
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+// throttle wraps reader so reads wait on limiter. A nil limiter returns reader unchanged.
+func throttle(ctx context.Context, reader io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, reader: reader, limiter: limiter}
+}
+
+// Read reads at most one burst and waits until the bucket has paid for the bytes read.
+func (throttled *throttledReader) Read(buffer []byte) (int, error) {
+	if len(buffer) > throttled.limiter.Burst() {
+		buffer = buffer[:throttled.limiter.Burst()]
+	}
+	n, err := throttled.reader.Read(buffer)
+	if n > 0 {
+		if waitErr := throttled.limiter.WaitN(throttled.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,201 @@
+package download
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// errDisallowedByRobots is returned when robots.txt forbids fetching a URL.
+var errDisallowedByRobots = errors.New("disallowed by robots.txt")
+
+// robotsChecker answers whether a URL may be fetched according to its host's robots.txt.
+// Each host's robots.txt is fetched once and cached. It is safe for concurrent use.
+type robotsChecker struct {
+	options httpOptions             // sends the robots.txt requests like any other, rate limits and headers included
+	fetches singleflight.Group      // robots.txt requests under way, keyed by origin
+	mutex   sync.Mutex              // guards hosts
+	hosts   map[string]*robotsRules // keyed by scheme://host
+}
+
+// newRobotsChecker returns a checker that fetches robots.txt as options describes and
+// applies the rules meant for its user agent.
+func newRobotsChecker(options httpOptions) *robotsChecker {
+	return &robotsChecker{
+		options: options,
+		hosts:   make(map[string]*robotsRules),
+	}
+}
+
+// allowed reports whether uri may be fetched. A nil checker allows everything.
+func (checker *robotsChecker) allowed(ctx context.Context, uri string) bool {
+	if checker == nil {
+		return true
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return true
+	}
+	rules := checker.rulesFor(ctx, parsed.Scheme+"://"+parsed.Host)
+	return rules.allowed(parsed.RequestURI())
+}
+
+// rulesFor returns the cached rules for origin, fetching robots.txt on first use. Concurrent
+// workers wait for a single request to each origin, without holding up the other origins.
+func (checker *robotsChecker) rulesFor(ctx context.Context, origin string) *robotsRules {
+	checker.mutex.Lock()
+	rules, ok := checker.hosts[origin]
+	checker.mutex.Unlock()
+	if ok {
+		return rules
+	}
+	value, _, _ := checker.fetches.Do(origin, func() (any, error) {
+		rules := checker.fetch(ctx, origin)
+		// A fetch cut short by cancellation says nothing about the host, so ask again next time.
+		if ctx.Err() == nil {
+			checker.mutex.Lock()
+			checker.hosts[origin] = rules
+			checker.mutex.Unlock()
+		}
+		return rules, nil
+	})
+	return value.(*robotsRules)
+}
+
+// fetch downloads and parses origin's robots.txt. A missing or unreachable file yields
+// rules that allow everything, which is how the tool behaved before robots.txt support.
+func (checker *robotsChecker) fetch(ctx context.Context, origin string) *robotsRules {
+	request, err := checker.options.newRequest(ctx, http.MethodGet, origin+"/robots.txt")
+	if err != nil {
+		return &robotsRules{}
+	}
+	response, err := checker.options.doWithRetry(request)
+	if err != nil {
+		slog.Warn("unable to fetch robots.txt, proceeding without it", "origin", origin, "error", err)
+		return &robotsRules{}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &robotsRules{}
+	}
+	// robots.txt files are small; cap the read in case the server misbehaves.
+	return parseRobots(io.LimitReader(response.Body, 512*1024), checker.options.userAgent)
+}
+
+// robotsRule is a single Allow or Disallow line.
+type robotsRule struct {
+	allow   bool
+	length  int            // length of the original pattern, used to pick the most specific rule
+	pattern *regexp.Regexp // the path pattern with * and $ translated
+}
+
+// robotsRules holds the rules that apply to our user agent on one host.
+type robotsRules struct {
+	rules []robotsRule
+}
+
+// allowed reports whether path (including any query) may be fetched. The longest matching
+// pattern wins and Allow wins ties, as described in RFC 9309.
+func (rules *robotsRules) allowed(path string) bool {
+	best := -1
+	allow := true
+	for _, rule := range rules.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > best || (rule.length == best && rule.allow) {
+			best = rule.length
+			allow = rule.allow
+		}
+	}
+	return allow
+}
+
+// parseRobots reads a robots.txt file and keeps the rules from the groups addressed to
+// userAgent, falling back to the * group when no group names it.
+func parseRobots(reader io.Reader, userAgent string) *robotsRules {
+	// Robots.txt matches on the product token, e.g. "ipcol-doc-scraper" in "ipcol-doc-scraper/1.0",
+	// which a group must name exactly, ignoring case (RFC 9309).
+	product := strings.ToLower(strings.SplitN(userAgent, "/", 2)[0])
+
+	var specific, wildcard []robotsRule
+	var groupAgents []string
+	inRules := false
+	// A group naming us replaces the * group even when it allows everything.
+	named := false
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Drop comments and surrounding whitespace.
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			// A user-agent line after rules starts a new group.
+			if inRules {
+				groupAgents = nil
+				inRules = false
+			}
+			// An empty name names no crawler.
+			agent := strings.ToLower(value)
+			if agent == "" {
+				continue
+			}
+			groupAgents = append(groupAgents, agent)
+			if agent == product {
+				named = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			// An empty Disallow means everything is allowed, so there's nothing to record.
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{
+				allow:   key == "allow",
+				length:  len(value),
+				pattern: robotsPattern(value),
+			}
+			for _, agent := range groupAgents {
+				switch {
+				case agent == "*":
+					wildcard = append(wildcard, rule)
+				case agent == product:
+					specific = append(specific, rule)
+				}
+			}
+		}
+	}
+	if named {
+		return &robotsRules{rules: specific}
+	}
+	return &robotsRules{rules: wildcard}
+}
+
+// robotsPattern converts a robots.txt path pattern into an anchored regular expression,
+// where * matches any sequence of characters and a trailing $ anchors the end.
+func robotsPattern(value string) *regexp.Regexp {
+	anchored := strings.HasSuffix(value, "$")
+	value = strings.TrimSuffix(value, "$")
+	expression := "^" + strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*")
+	if anchored {
+		expression += "$"
+	}
+	return regexp.MustCompile(expression)
+}
@@ -0,0 +1,152 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Sink is somewhere finished downloads are published to. The output directory stays the
+// working copy (it holds partial files, checksums and what later runs skip), and every file
+// saved there is also handed to the sink.
+type Sink interface {
+	// Store saves everything read from data under name, a slash separated path such as
+	// "ab/file.pdf". Storing the same name again replaces the earlier copy. Cancelling ctx
+	// abandons the copy.
+	Store(ctx context.Context, name string, data io.Reader) error
+}
+
+// NewSink returns the sink described by spec: an s3://bucket/prefix URL for an S3 compatible
+// bucket or a local directory to mirror the files into. An empty spec returns a nil sink.
+// The S3 credentials come from the environment (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY,
+// MINIO_ROOT_USER and MINIO_ROOT_PASSWORD, or ~/.aws/credentials), never from flags.
+func NewSink(spec, endpoint, region string) (Sink, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(spec, "s3://") {
+		return localSink{root: spec}, nil
+	}
+	target, err := url.Parse(spec)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("invalid sink %q: expected s3://bucket/prefix", spec)
+	}
+	// A bare host name means HTTPS; a full URL may ask for plain HTTP, as local MinIO setups often do.
+	secure := true
+	if parsed, err := url.Parse(endpoint); err == nil && parsed.Host != "" {
+		secure = parsed.Scheme != "http"
+		endpoint = parsed.Host
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+		}),
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("set up S3 client for %s: %w", endpoint, err)
+	}
+	return &s3Sink{
+		client: client,
+		bucket: target.Host,
+		prefix: strings.Trim(target.Path, "/"),
+	}, nil
+}
+
+// localSink mirrors files into a directory on the local filesystem.
+type localSink struct {
+	root string
+}
+
+// Store writes data to a temporary file next to the destination and renames it into place,
+// so the mirror never holds a half-written file.
+func (sink localSink) Store(_ context.Context, name string, data io.Reader) error {
+	destination := filepath.Join(sink.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(destination), 0o755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(destination), ".sink-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(temp, data)
+	err = errors.Join(err, temp.Close())
+	if err == nil {
+		err = os.Rename(temp.Name(), destination)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// s3Sink uploads files to a bucket on S3 or an S3 compatible service such as MinIO.
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+	prefix string // key prefix without surrounding slashes; may be empty
+}
+
+// Store uploads data as the object prefix/name.
+func (sink *s3Sink) Store(ctx context.Context, name string, data io.Reader) error {
+	// A known size lets the upload go out in one request instead of buffered parts.
+	size := int64(-1)
+	if file, ok := data.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	_, err := sink.client.PutObject(ctx, sink.bucket, path.Join(sink.prefix, name), data, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+// publish hands the file a successful download saved under root, and any PDFs extracted from
+// it, to options.sink, if one is set. When that fails the local copies are removed too, since
+// later runs skip a file that is present and would never try the upload again.
+func (options downloadOptions) publish(ctx context.Context, record Record, root string) error {
+	if options.sink == nil {
+		return nil
+	}
+	names := append([]string{record.Filename}, record.Extracted...)
+	for _, name := range names {
+		if err := options.store(ctx, root, name); err != nil {
+			for _, name := range names {
+				filePath := filepath.Join(root, filepath.FromSlash(name))
+				options.disk().Remove(filePath)
+				options.disk().Remove(filePath + checksumSuffix)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// store hands the file saved under root as name to options.sink.
+func (options downloadOptions) store(ctx context.Context, root, name string) error {
+	file, err := openFile(options.disk(), filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return fmt.Errorf("store %s in sink: %w", name, err)
+	}
+	defer file.Close()
+	if err := options.sink.Store(ctx, name, file); err != nil {
+		return fmt.Errorf("store %s in sink: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package download
+
+import (
+	"sync"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+)
+
+// URLSet is a set of URLs that keeps the order they were added in. The crawler collects the
+// links it finds in one and the downloader claims links in another, which the crawler also
+// consults through Crawl.Claimed, so the same URL is never worked on twice however it was
+// reached. URLs are compared by their extract.NormalizeURL
+// form, but the set keeps each one as it was first added, since that is the URL to request.
+// The zero value is an empty set; it is safe for concurrent use.
+type URLSet struct {
+	mutex sync.Mutex
+	urls  map[string]struct{}
+	order []string
+}
+
+// Add puts uri in the set and reports whether it was new.
+func (set *URLSet) Add(uri string) bool {
+	key := extract.NormalizeURL(uri)
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if _, ok := set.urls[key]; ok {
+		return false
+	}
+	if set.urls == nil {
+		set.urls = make(map[string]struct{})
+	}
+	set.urls[key] = struct{}{}
+	set.order = append(set.order, uri)
+	return true
+}
+
+// Contains reports whether uri, in any form, is in the set.
+func (set *URLSet) Contains(uri string) bool {
+	key := extract.NormalizeURL(uri)
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	_, ok := set.urls[key]
+	return ok
+}
+
+// Snapshot returns a copy of the URLs in the order they were first added.
+func (set *URLSet) Snapshot() []string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return append([]string(nil), set.order...)
+}
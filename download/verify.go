@@ -0,0 +1,75 @@
+package download
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ChecksumProblem is a file that failed Verify.
+type ChecksumProblem struct {
+	Path   string
+	Reason string // "mismatch", "missing", or why the file couldn't be checked
+}
+
+// Verify checks every file under dir that has a checksum sidecar against it and
+// returns how many were checked and the ones that failed, sorted by path. Hashing a large
+// cache one file at a time is slow, so up to workers files are read and hashed at once.
+func Verify(ctx context.Context, dir string, workers int) (int, []ChecksumProblem, error) {
+	files := osFileSystem{}
+	paths := make(chan string)
+	var mutex sync.Mutex
+	var problems []ChecksumProblem
+	checked := 0
+	var waitGroup sync.WaitGroup
+	for range max(workers, 1) {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for filePath := range paths {
+				var problem ChecksumProblem
+				matches, err := checksumMatches(files, filePath)
+				switch {
+				case errors.Is(err, fs.ErrNotExist):
+					problem = ChecksumProblem{Path: filePath, Reason: "missing"}
+				case err != nil:
+					problem = ChecksumProblem{Path: filePath, Reason: err.Error()}
+				case !matches:
+					problem = ChecksumProblem{Path: filePath, Reason: "mismatch"}
+				}
+				mutex.Lock()
+				checked++
+				if problem.Path != "" {
+					problems = append(problems, problem)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	// Every sidecar names a file to check; files without one have nothing to compare against.
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, checksumSuffix) {
+			return nil
+		}
+		select {
+		case paths <- strings.TrimSuffix(path, checksumSuffix):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(paths)
+	waitGroup.Wait()
+	slices.SortFunc(problems, func(a, b ChecksumProblem) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+	return checked, problems, err
+}
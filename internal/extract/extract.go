@@ -0,0 +1,483 @@
+// Package extract holds the pure helpers that find PDF links in listing pages and turn
+// URLs into canonical forms and file names. Nothing in it touches the network or the disk.
+package extract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"mime"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// pdfLinkRegex matches absolute http(s) URLs ending in .pdf in any letter case, with optional
+// ;parameters (such as ;jsessionid=...) and an optional query. The links are matched after
+// resolveLink has escaped them, so percent signs, commas, parentheses and semicolons in the
+// path are all part of the match.
+var pdfLinkRegex = regexp.MustCompile(`(?i)^https?://[^\s"'<>]+?\.pdf(?:;[^\s"'<>?]*)?(?:\?[^\s"'<>]*)?$`)
+
+// PDFLinks parses htmlContent and returns all unique .pdf URLs referenced by
+// <a href>, <iframe src> and <embed src>. Relative links are resolved against baseURL.
+func PDFLinks(htmlContent, baseURL string) []string {
+	return MatchingLinks(htmlContent, baseURL, pdfLinkRegex)
+}
+
+// zipLinkRegex matches absolute http(s) URLs ending in .zip in any letter case (with an optional query).
+var zipLinkRegex = regexp.MustCompile(`(?i)^https?://[^\s"'<>]+?\.zip(?:\?[^\s"'<>]*)?$`)
+
+// ZipLinks is PDFLinks for .zip archives, such as bundles of safety data sheets.
+func ZipLinks(htmlContent, baseURL string) []string {
+	return MatchingLinks(htmlContent, baseURL, zipLinkRegex)
+}
+
+// IsZipLink reports whether the path of rawURL ends in .zip, in any letter case.
+func IsZipLink(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	return err == nil && strings.EqualFold(path.Ext(parsed.Path), ".zip")
+}
+
+// MatchingLinks is PDFLinks with a caller supplied pattern: it returns the unique absolute
+// links from <a href>, <iframe src> and <embed src> that pattern matches.
+func MatchingLinks(htmlContent, baseURL string, pattern *regexp.Regexp) []string {
+	// Parse the document into a DOM tree.
+	document, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		slog.Warn("unable to parse HTML", "error", err)
+		return nil
+	}
+
+	// Parse the base URL once; without it relative links can't be resolved.
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		slog.Warn("unable to parse base URL", "url", baseURL, "error", err)
+		base = nil
+	}
+
+	seen := make(map[string]struct{})
+	var links []string
+
+	// Walk every element and inspect the attribute that holds its target.
+	for node := range document.Descendants() {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		var attributeName string
+		switch node.DataAtom {
+		case atom.A:
+			attributeName = "href"
+		case atom.Iframe, atom.Embed:
+			attributeName = "src"
+		default:
+			continue
+		}
+		for _, attribute := range node.Attr {
+			if attribute.Key != attributeName {
+				continue
+			}
+			link := resolveLink(base, attribute.Val)
+			if link == "" || !pattern.MatchString(link) {
+				continue
+			}
+			if _, ok := seen[link]; !ok {
+				seen[link] = struct{}{}
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links
+}
+
+// pageExtensions are the file extensions of links worth fetching as HTML pages while crawling.
+// Links without an extension are assumed to be pages as well.
+var pageExtensions = []string{"", ".html", ".htm", ".php", ".asp", ".aspx", ".jsp"}
+
+// PageLinks parses htmlContent and returns the unique <a href> links to other HTML pages on
+// the same host as baseURL, so a crawler can follow them. PDFs, other hosts and obvious
+// non-page files such as images are left out.
+func PageLinks(htmlContent, baseURL string) []string {
+	document, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		slog.Warn("unable to parse HTML", "error", err)
+		return nil
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		slog.Warn("unable to parse base URL", "url", baseURL, "error", err)
+		return nil
+	}
+
+	seen := make(map[string]struct{})
+	var links []string
+	for node := range document.Descendants() {
+		if node.Type != html.ElementNode || node.DataAtom != atom.A {
+			continue
+		}
+		for _, attribute := range node.Attr {
+			if attribute.Key != "href" {
+				continue
+			}
+			link := resolveLink(base, attribute.Val)
+			parsed, err := url.Parse(link)
+			if link == "" || err != nil || pdfLinkRegex.MatchString(link) {
+				continue
+			}
+			// Stay on the listing's site and skip mailto:, javascript: and the like.
+			if (parsed.Scheme != "http" && parsed.Scheme != "https") || !strings.EqualFold(parsed.Host, base.Host) {
+				continue
+			}
+			if !slices.Contains(pageExtensions, strings.ToLower(path.Ext(parsed.Path))) {
+				continue
+			}
+			if _, ok := seen[link]; !ok {
+				seen[link] = struct{}{}
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// pageNumberRegex captures the page number from pagination URLs like ?page=2 or /page/2/.
+var pageNumberRegex = regexp.MustCompile(`(?:[?&]page=|/page/)(\d+)`)
+
+// NextPageLink returns the absolute URL of the page after pageURL, or an empty string
+// on the last page. A rel="next" link wins; otherwise a link to page N+1 is used.
+func NextPageLink(htmlContent, pageURL string) string {
+	document, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		slog.Warn("unable to parse HTML", "error", err)
+		return ""
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		slog.Warn("unable to parse page URL", "url", pageURL, "error", err)
+		return ""
+	}
+	// Work out which page number comes next; an unnumbered page is the first.
+	currentPage := 1
+	if match := pageNumberRegex.FindStringSubmatch(pageURL); match != nil {
+		currentPage, _ = strconv.Atoi(match[1])
+	}
+	wantedPage := strconv.Itoa(currentPage + 1)
+
+	numberedNext := ""
+	for node := range document.Descendants() {
+		if node.Type != html.ElementNode || (node.DataAtom != atom.A && node.DataAtom != atom.Link) {
+			continue
+		}
+		var href, rel string
+		for _, attribute := range node.Attr {
+			switch attribute.Key {
+			case "href":
+				href = attribute.Val
+			case "rel":
+				rel = attribute.Val
+			}
+		}
+		if href == "" {
+			continue
+		}
+		// An explicit rel="next" is the most reliable signal.
+		if slices.Contains(strings.Fields(strings.ToLower(rel)), "next") {
+			return resolveLink(base, href)
+		}
+		// Otherwise remember the first link that points at the following page number.
+		if numberedNext == "" {
+			if match := pageNumberRegex.FindStringSubmatch(href); match != nil && match[1] == wantedPage {
+				numberedNext = resolveLink(base, href)
+			}
+		}
+	}
+	return numberedNext
+}
+
+// resolveLink turns an attribute value into an absolute URL without a fragment.
+// It returns an empty string when the value can't be parsed.
+func resolveLink(base *url.URL, rawLink string) string {
+	reference, err := url.Parse(escapeStrayPercents(strings.TrimSpace(rawLink)))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		reference = base.ResolveReference(reference)
+	}
+	// Protocol-relative links (//host/path) take the page's scheme when resolved above;
+	// without a usable base page fall back to https so they still become absolute.
+	if reference.Scheme == "" && reference.Host != "" {
+		reference.Scheme = "https"
+	}
+	// Fragments only point inside the document, so they don't change what gets downloaded.
+	reference.Fragment = ""
+	return reference.String()
+}
+
+// escapeStrayPercents escapes every % that doesn't start a %XX escape, as in "100%.pdf",
+// which url.Parse would reject although browsers follow such links.
+func escapeStrayPercents(rawLink string) string {
+	var builder strings.Builder
+	for index := 0; index < len(rawLink); index++ {
+		builder.WriteByte(rawLink[index])
+		if rawLink[index] == '%' && !(index+2 < len(rawLink) && isHex(rawLink[index+1]) && isHex(rawLink[index+2])) {
+			builder.WriteString("25")
+		}
+	}
+	return builder.String()
+}
+
+// isHex reports whether c is a hexadecimal digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// URLToFilename converts a URL into a filesystem-safe filename
+func URLToFilename(rawURL string) string {
+	parsed, err := url.Parse(rawURL) // Parse the URL
+	// Print the errors if any.
+	if err != nil {
+		slog.Warn("unable to parse URL", "url", rawURL, "error", err)
+		return "" // Return empty string on error
+	}
+	filename := parsed.Host // Start with host name
+	// Parse the path and if its not empty replace them with valid characters.
+	if parsed.Path != "" {
+		filename += "_" + strings.ReplaceAll(parsed.Path, "/", "_") // Append path
+	}
+	if parsed.RawQuery != "" {
+		// Decode the query like the path, so name=Foo%20Bar names the file "foo bar".
+		query, err := url.QueryUnescape(parsed.RawQuery)
+		if err != nil {
+			query = parsed.RawQuery
+		}
+		filename += "_" + strings.ReplaceAll(query, "&", "_") // Append query
+	}
+	return SanitizeFilename(filename) // Return sanitized filename
+}
+
+// BasenameFilename returns the sanitized last path segment of a URL, such as
+// "product-x.pdf" for https://ipcol.com/sds/Product-X.pdf, or an empty string when the
+// path has no segment to use. Different URLs can share a basename, so callers must check.
+func BasenameFilename(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		slog.Warn("unable to parse URL", "url", rawURL, "error", err)
+		return ""
+	}
+	name := path.Base(parsed.Path)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return SanitizeFilename(name)
+}
+
+// ZipMemberFilename returns the file name a PDF inside a ZIP archive is extracted to: the
+// archive's name without its extension, an underscore and the member's base name, sanitized.
+// It reports false for members that aren't PDFs and for names that try to leave the
+// extraction directory, such as ../../etc/passwd.pdf or /tmp/x.pdf (a "zip slip").
+func ZipMemberFilename(archiveName, member string) (string, bool) {
+	// Archives made on Windows may use backslashes as separators.
+	member = strings.ReplaceAll(member, `\`, "/")
+	if !strings.EqualFold(path.Ext(member), ".pdf") || path.IsAbs(member) || filepath.VolumeName(member) != "" {
+		return "", false
+	}
+	for _, segment := range strings.Split(member, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	stem := strings.TrimSuffix(archiveName, path.Ext(archiveName))
+	return SanitizeFilename(stem + "_" + path.Base(member)), true
+}
+
+// HashedFilename is URLToFilename with the first 8 hex characters of the SHA-256 of the full
+// URL inserted before the extension, so URLs that sanitize to the same name still get distinct files.
+func HashedFilename(rawURL string) string {
+	return HashName(URLToFilename(rawURL), rawURL)
+}
+
+// HashName inserts the first 8 hex characters of the SHA-256 of rawURL before the extension of
+// filename, so a name the server suggests for several URLs still gives each of them a file.
+func HashName(filename, rawURL string) string {
+	if filename == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	// Shorten the name rather than the hash when the result would be too long.
+	extension := path.Ext(filename)
+	suffix := "_" + hex.EncodeToString(sum[:4]) + extension
+	return truncateStem(strings.TrimSuffix(filename, extension), MaxFilenameLength-len(suffix)) + suffix
+}
+
+// MaxFilenameLength is the longest file name, in bytes, that SanitizeFilename returns. Most
+// filesystems allow 255; the rest leaves room for the ".part" and ".sha256" suffixes of the
+// files kept next to a download.
+const MaxFilenameLength = 240
+
+// reservedNameRegex matches the device names Windows reserves, with or without an extension.
+var reservedNameRegex = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9]|lpt[0-9])$`)
+
+// SanitizeFilename replaces characters that are illegal in file names, makes sure the
+// name ends in .pdf and lowercases it. The result is also safe on Windows: reserved device
+// names get a leading underscore, trailing dots and spaces are dropped, and the name is
+// shortened to MaxFilenameLength bytes.
+func SanitizeFilename(filename string) string {
+	invalidChars := []string{`"`, `\`, `/`, `:`, `*`, `?`, `<`, `>`, `|`} // Define illegal filename characters
+	// Loop over the invalid characters and replace them.
+	for _, char := range invalidChars {
+		filename = strings.ReplaceAll(filename, char, "_") // Replace each with underscore
+	}
+	// Control characters are just as illegal on Windows.
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, filename)
+	// The extension may be in any case (.PDF, .Pdf); the name is lowercased below.
+	if strings.ToLower(getFileExtension(filename)) != ".pdf" {
+		filename = filename + ".pdf"
+	}
+	filename = strings.ToLower(filename)
+	extension := getFileExtension(filename)
+	stem := strings.TrimRight(strings.TrimSuffix(filename, extension), ". ")
+	// Windows treats "con.pdf" like the console itself, whatever the extension.
+	if first, _, _ := strings.Cut(stem, "."); reservedNameRegex.MatchString(strings.TrimRight(first, " ")) {
+		stem = "_" + stem
+	}
+	return truncateStem(stem, MaxFilenameLength-len(extension)) + extension
+}
+
+// truncateStem shortens a file name without its extension to at most limit bytes, cutting at a
+// character boundary, and drops the trailing dots and spaces Windows can't handle.
+func truncateStem(stem string, limit int) string {
+	if len(stem) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(stem[cut]) {
+			cut--
+		}
+		stem = stem[:cut]
+	}
+	stem = strings.TrimRight(stem, ". ")
+	if stem == "" {
+		return "_"
+	}
+	return stem
+}
+
+// DispositionFilename returns the sanitized file name suggested by a Content-Disposition
+// header, or an empty string when the header doesn't carry one.
+func DispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	// ParseMediaType already decodes the RFC 5987 filename* form into "filename".
+	name := strings.TrimSpace(params["filename"])
+	// Keep only the last path element so a header can't point outside the output directory.
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	if name == "" || name == "." || name == ".." {
+		return ""
+	}
+	return SanitizeFilename(name)
+}
+
+// Get the file extension of a file
+func getFileExtension(path string) string {
+	return filepath.Ext(path)
+}
+
+// Check if the given url is valid.
+func IsURLValid(uri string) bool {
+	_, err := url.ParseRequestURI(uri)
+	return err == nil
+}
+
+// FilterLinks keeps the links that match include (when set) and don't match exclude (when set).
+func FilterLinks(links []string, include, exclude *regexp.Regexp) []string {
+	var kept []string
+	for _, link := range links {
+		if include != nil && !include.MatchString(link) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(link) {
+			continue
+		}
+		kept = append(kept, link)
+	}
+	return kept
+}
+
+// RemoveDuplicatesFromSliceSorted removes all the duplicates from a slice and returns
+// the remaining values in sorted order.
+func RemoveDuplicatesFromSliceSorted(slice []string) []string {
+	unique := RemoveDuplicatesFromSlice(slice)
+	sort.Strings(unique)
+	return unique
+}
+
+// NormalizeURL returns raw in a canonical form: lowercase scheme and host, no default port,
+// no fragment, sorted query parameters and no trailing slash or empty "?". The path keeps
+// its case because servers may treat it as case-sensitive. Unparseable input is returned as is,
+// and so is a query that can't be parsed. The result is only meant for comparing URLs: it
+// rewrites the query in ways a server may not accept, so request the original instead.
+func NormalizeURL(raw string) string {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return raw
+	}
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	// Drop the port when it is the default for the scheme.
+	host := strings.ToLower(parsed.Hostname())
+	port := parsed.Port()
+	if (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// Keep IPv6 literals bracketed.
+		host = "[" + host + "]"
+	}
+	parsed.Host = host
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	parsed.ForceQuery = false
+	// Encode sorts the parameters by key.
+	if query, err := url.ParseQuery(parsed.RawQuery); err == nil && parsed.RawQuery != "" {
+		parsed.RawQuery = query.Encode()
+	}
+	// A trailing slash doesn't name a different document.
+	if len(parsed.Path) > 1 {
+		parsed.Path = strings.TrimRight(parsed.Path, "/")
+		parsed.RawPath = strings.TrimRight(parsed.RawPath, "/")
+	}
+	return parsed.String()
+}
+
+// Remove all the duplicates from a slice and return the slice.
+func RemoveDuplicatesFromSlice(slice []string) []string {
+	check := make(map[string]bool)
+	var newReturnSlice []string
+	for _, content := range slice {
+		if !check[content] {
+			check[content] = true
+			newReturnSlice = append(newReturnSlice, content)
+		}
+	}
+	return newReturnSlice
+}
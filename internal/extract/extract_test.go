@@ -0,0 +1,310 @@
+package extract
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPDFLinksMixedCaseExtension(t *testing.T) {
+	content := `<a href="/docs/upper.PDF">Upper</a>
+<a href="/docs/mixed.Pdf?rev=2">Mixed</a>
+<a href="/docs/lower.pdf">Lower</a>
+<a href="/docs/page.html">Not a PDF</a>`
+	got := PDFLinks(content, "https://ipcol.com/safety-data-sheets")
+	want := []string{
+		"https://ipcol.com/docs/upper.PDF",
+		"https://ipcol.com/docs/mixed.Pdf?rev=2",
+		"https://ipcol.com/docs/lower.pdf",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("PDFLinks() = %q, want %q", got, want)
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	content := `<a href="/products/widget">Product</a>
+<a href="/products/widget#specs">Same product</a>
+<a href="https://ipcol.com/about.html">About</a>
+<a href="/docs/sds.pdf">A PDF</a>
+<a href="/images/logo.png">An image</a>
+<a href="https://example.com/elsewhere">Another site</a>
+<a href="mailto:info@ipcol.com">Mail</a>`
+	got := PageLinks(content, "https://ipcol.com/safety-data-sheets")
+	want := []string{
+		"https://ipcol.com/products/widget",
+		"https://ipcol.com/about.html",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("PageLinks() = %q, want %q", got, want)
+	}
+}
+
+func TestURLToFilenameMixedCaseExtension(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://ipcol.com/docs/SDS-Product.PDF", "ipcol.com__docs_sds-product.pdf"},
+		{"https://ipcol.com/docs/sds.Pdf", "ipcol.com__docs_sds.pdf"},
+		{"https://ipcol.com/docs/sds.pdf", "ipcol.com__docs_sds.pdf"},
+	}
+	for _, test := range tests {
+		if got := URLToFilename(test.url); got != test.want {
+			t.Errorf("URLToFilename(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestBasenameFilename(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://ipcol.com/documents/safety/sds/Product-X.pdf", "product-x.pdf"},
+		{"https://ipcol.com/sds/Product%20X.pdf?v=2", "product x.pdf"},
+		{"https://ipcol.com/sds/download", "download.pdf"},
+		{"https://ipcol.com/", ""},
+		{"https://ipcol.com", ""},
+	}
+	for _, test := range tests {
+		if got := BasenameFilename(test.url); got != test.want {
+			t.Errorf("BasenameFilename(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameCrossPlatform(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"CON.pdf", "_con.pdf"},
+		{"nul", "_nul.pdf"},
+		{"com1.tar.pdf", "_com1.tar.pdf"},
+		{"lpt9 .pdf", "_lpt9.pdf"},
+		{"console.pdf", "console.pdf"},
+		{"report. . .pdf", "report.pdf"},
+		{"tab\there.pdf", "tab_here.pdf"},
+		{"...pdf", "_.pdf"},
+	}
+	for _, test := range tests {
+		if got := SanitizeFilename(test.name); got != test.want {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameCapsLength(t *testing.T) {
+	// Multi-byte characters must not be cut in half.
+	long := strings.Repeat("é", 200) + ".pdf"
+	got := SanitizeFilename(long)
+	if len(got) > MaxFilenameLength || !strings.HasSuffix(got, ".pdf") || !utf8.ValidString(got) {
+		t.Errorf("SanitizeFilename(<%d bytes>) = %d bytes %q, want at most %d valid bytes ending in .pdf", len(long), len(got), got, MaxFilenameLength)
+	}
+	// Hashed names keep their hash when shortened, so long URLs stay distinct.
+	first := HashedFilename("https://ipcol.com/" + strings.Repeat("a", 300) + "/1.pdf")
+	second := HashedFilename("https://ipcol.com/" + strings.Repeat("a", 300) + "/2.pdf")
+	if len(first) > MaxFilenameLength || first == second {
+		t.Errorf("HashedFilename() = %q and %q, want distinct names of at most %d bytes", first, second, MaxFilenameLength)
+	}
+}
+
+func TestHashedFilenameAvoidsCollisions(t *testing.T) {
+	first := "https://ipcol.com/a/b.pdf"
+	second := "https://ipcol.com/a_b.pdf"
+	// Both URLs sanitize to the same plain name.
+	if URLToFilename(first) != URLToFilename(second) {
+		t.Fatalf("URLToFilename() no longer collides for %q and %q", first, second)
+	}
+	if HashedFilename(first) == HashedFilename(second) {
+		t.Errorf("HashedFilename() = %q for both %q and %q", HashedFilename(first), first, second)
+	}
+	if got, want := HashedFilename(first), "ipcol.com__a_b_"; !strings.HasPrefix(got, want) || !strings.HasSuffix(got, ".pdf") || len(got) != len(want)+8+len(".pdf") {
+		t.Errorf("HashedFilename(%q) = %q, want %s<8 hex chars>.pdf", first, got, want)
+	}
+	// The same URL always maps to the same name.
+	if HashedFilename(first) != HashedFilename(first) {
+		t.Error("HashedFilename() is not deterministic")
+	}
+}
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="SDS-Product-123.pdf"`, "sds-product-123.pdf"},
+		{`attachment; filename="../../etc/passwd"`, "passwd.pdf"},
+		{`attachment; filename="a:b?.pdf"`, "a_b_.pdf"},
+		{`inline`, ""},
+		{``, ""},
+	}
+	for _, test := range tests {
+		if got := DispositionFilename(test.header); got != test.want {
+			t.Errorf("DispositionFilename(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"https://ipcol.com/a.pdf", "https://ipcol.com/a.pdf"},
+		{"HTTPS://IPCOL.com/a.pdf", "https://ipcol.com/a.pdf"},
+		{"https://ipcol.com/a.pdf?", "https://ipcol.com/a.pdf"},
+		{"https://ipcol.com/a.pdf#page=2", "https://ipcol.com/a.pdf"},
+		{"https://ipcol.com:443/a.pdf", "https://ipcol.com/a.pdf"},
+		{"http://ipcol.com:80/a.pdf", "http://ipcol.com/a.pdf"},
+		{"http://ipcol.com:8080/a.pdf", "http://ipcol.com:8080/a.pdf"},
+		{"https://ipcol.com/a.pdf/", "https://ipcol.com/a.pdf"},
+		{"https://ipcol.com/a.pdf?b=2&a=1", "https://ipcol.com/a.pdf?a=1&b=2"},
+		{"https://ipcol.com/A.pdf", "https://ipcol.com/A.pdf"},
+		{"https://ipcol.com/a.pdf?x=1;y=2", "https://ipcol.com/a.pdf?x=1;y=2"},
+	}
+	for _, test := range tests {
+		if got := NormalizeURL(test.raw); got != test.want {
+			t.Errorf("NormalizeURL(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeURLCollapsesVariants(t *testing.T) {
+	variants := []string{
+		"https://ipcol.com/a.pdf",
+		"https://IPCOL.COM/a.pdf?",
+		"https://ipcol.com:443/a.pdf#top",
+	}
+	var normalized []string
+	for _, variant := range variants {
+		normalized = append(normalized, NormalizeURL(variant))
+	}
+	if got := RemoveDuplicatesFromSlice(normalized); len(got) != 1 {
+		t.Errorf("RemoveDuplicatesFromSlice() = %q, want a single URL", got)
+	}
+}
+
+func TestFilterLinks(t *testing.T) {
+	links := []string{
+		"https://ipcol.com/sds/product-a.pdf",
+		"https://ipcol.com/sds/product-b.pdf",
+		"https://ipcol.com/brochures/catalogue.pdf",
+	}
+	include := regexp.MustCompile(`/sds/`)
+	exclude := regexp.MustCompile(`product-b`)
+	tests := []struct {
+		name             string
+		include, exclude *regexp.Regexp
+		want             []string
+	}{
+		{"no filters", nil, nil, links},
+		{"include only", include, nil, links[:2]},
+		{"exclude only", nil, exclude, []string{links[0], links[2]}},
+		{"include and exclude", include, exclude, links[:1]},
+	}
+	for _, test := range tests {
+		if got := FilterLinks(links, test.include, test.exclude); !slices.Equal(got, test.want) {
+			t.Errorf("%s: FilterLinks() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRemoveDuplicatesFromSlice(t *testing.T) {
+	input := []string{"c", "a", "c", "b", "a"}
+	if got, want := RemoveDuplicatesFromSlice(input), []string{"c", "a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("RemoveDuplicatesFromSlice() = %q, want %q", got, want)
+	}
+	if got, want := RemoveDuplicatesFromSliceSorted(input), []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("RemoveDuplicatesFromSliceSorted() = %q, want %q", got, want)
+	}
+}
+
+func TestPDFLinksProtocolRelative(t *testing.T) {
+	content := `<a href="//cdn.ipcol.com/sds/file.pdf">CDN</a>`
+	tests := []struct {
+		baseURL string
+		want    string
+	}{
+		{"https://ipcol.com/safety-data-sheets", "https://cdn.ipcol.com/sds/file.pdf"},
+		{"http://ipcol.com/safety-data-sheets", "http://cdn.ipcol.com/sds/file.pdf"},
+		{"", "https://cdn.ipcol.com/sds/file.pdf"},
+	}
+	for _, test := range tests {
+		got := PDFLinks(content, test.baseURL)
+		if want := []string{test.want}; !slices.Equal(got, want) {
+			t.Errorf("PDFLinks(base %q) = %q, want %q", test.baseURL, got, want)
+		}
+	}
+}
+
+func TestZipLinks(t *testing.T) {
+	content := `<a href="/bundles/SDS-2024.ZIP">Bundle</a>
+<a href="/docs/sds.pdf">A PDF</a>
+<a href="/bundles/archive.zip?v=3">Versioned</a>`
+	got := ZipLinks(content, "https://ipcol.com/safety-data-sheets")
+	want := []string{"https://ipcol.com/bundles/SDS-2024.ZIP", "https://ipcol.com/bundles/archive.zip?v=3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ZipLinks() = %q, want %q", got, want)
+	}
+	if !IsZipLink(want[1]) || IsZipLink("https://ipcol.com/docs/sds.pdf") {
+		t.Error("IsZipLink() misjudged a link")
+	}
+}
+
+func TestZipMemberFilename(t *testing.T) {
+	tests := []struct {
+		member string
+		want   string
+		ok     bool
+	}{
+		{"Product A.pdf", "bundle_product a.pdf", true},
+		{"sds/en/Product-B.PDF", "bundle_product-b.pdf", true},
+		{`sds\Product-C.pdf`, "bundle_product-c.pdf", true},
+		{"readme.txt", "", false},
+		{"../../etc/evil.pdf", "", false},
+		{"sds/../../evil.pdf", "", false},
+		{"/tmp/evil.pdf", "", false},
+	}
+	for _, test := range tests {
+		got, ok := ZipMemberFilename("bundle.zip", test.member)
+		if got != test.want || ok != test.ok {
+			t.Errorf("ZipMemberFilename(%q) = %q, %v, want %q, %v", test.member, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestPDFLinksWithEncodedCharacters(t *testing.T) {
+	content := `<a href="/docs/Foo Bar (EN), v2;rev.pdf">Spaces, commas and parentheses</a>
+<a href="/docs/Safety%20Data%20Sheet%20-%20Product%20X.pdf">Already encoded</a>
+<a href="/docs/caf%C3%A9.pdf#page=2">Encoded UTF-8 with a fragment</a>
+<a href="/docs/100%.pdf">Stray percent sign</a>
+<a href="/docs/sds.pdf;jsessionid=AB12">Path parameter</a>
+<a href="/get.pdf?name=Foo%20Bar%2C%20Inc.">Encoded query</a>`
+	tests := []struct {
+		link     string
+		filename string
+	}{
+		{"https://ipcol.com/docs/Foo%20Bar%20%28EN%29,%20v2;rev.pdf", "ipcol.com__docs_foo bar (en), v2;rev.pdf"},
+		{"https://ipcol.com/docs/Safety%20Data%20Sheet%20-%20Product%20X.pdf", "ipcol.com__docs_safety data sheet - product x.pdf"},
+		{"https://ipcol.com/docs/caf%C3%A9.pdf", "ipcol.com__docs_café.pdf"},
+		{"https://ipcol.com/docs/100%25.pdf", "ipcol.com__docs_100%.pdf"},
+		{"https://ipcol.com/docs/sds.pdf;jsessionid=AB12", "ipcol.com__docs_sds.pdf;jsessionid=ab12.pdf"},
+		{"https://ipcol.com/get.pdf?name=Foo%20Bar%2C%20Inc.", "ipcol.com__get.pdf_name=foo bar, inc.pdf"},
+	}
+	got := PDFLinks(content, "https://ipcol.com/safety-data-sheets")
+	if len(got) != len(tests) {
+		t.Fatalf("PDFLinks() = %q, want %d links", got, len(tests))
+	}
+	for index, test := range tests {
+		if got[index] != test.link {
+			t.Errorf("link %d = %q, want %q", index, got[index], test.link)
+		}
+		if filename := URLToFilename(test.link); filename != test.filename {
+			t.Errorf("URLToFilename(%q) = %q, want %q", test.link, filename, test.filename)
+		}
+	}
+}
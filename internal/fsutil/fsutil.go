@@ -0,0 +1,101 @@
+// Package fsutil holds the small file system helpers shared by the scraper.
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Checks if the directory exists
+// If it exists, return true.
+// If it doesn't, return false.
+// Any other failure, such as a permission error, is returned rather than read as absence.
+func DirectoryExists(path string) (bool, error) {
+	directory, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return directory.IsDir(), nil
+}
+
+// The function takes two parameters: path and permission.
+// We use os.MkdirAll() so any missing parent directories are created as well.
+// If there is an error, it is returned so the caller can decide whether to abort.
+func CreateDirectory(path string, permission os.FileMode) error {
+	err := os.MkdirAll(path, permission)
+	if err != nil {
+		return fmt.Errorf("create directory %s: %w", path, err)
+	}
+	return nil
+}
+
+// CheckWritable creates and removes a temporary file in dir to prove files can be saved there.
+func CheckWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	name := file.Name()
+	err = errors.Join(file.Close(), os.Remove(name))
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+// Read a file and return the contents
+func ReadAFileAsString(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("unable to read file", "error", err)
+	}
+	return string(content)
+}
+
+// FileOlderThan reports whether the file at path was last modified more than age ago.
+func FileOlderThan(path string, age time.Duration) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) > age
+}
+
+/*
+It takes in a path and content to write to that file.
+It uses the os.WriteFile function to write the content to that file.
+Any error is returned, since a failed write can leave the file empty or truncated.
+*/
+func WriteToFile(path string, content []byte) error {
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		return fmt.Errorf("write file %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteFileAtomic writes content to a temporary file next to path and renames it into place,
+// so readers and later runs never see a half written file.
+func WriteFileAtomic(path string, content []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("write file %s: %w", path, err)
+	}
+	_, err = temp.Write(content)
+	err = errors.Join(err, temp.Close())
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("write file %s: %w", path, err)
+	}
+	return nil
+}
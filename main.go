@@ -1,269 +1,879 @@
 package main
 
 import (
-	// "fmt"
-	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/download"
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/extract"
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/fsutil"
 )
 
+// defaultConcurrency is the number of PDFs downloaded in parallel.
+const defaultConcurrency = 8
+
+// defaultMaxAttempts is how many times a request is tried before giving up.
+const defaultMaxAttempts = 3
+
 func main() {
-	// The file URL to download.
-	remoteFileURL := "https://ipcol.com/safety-data-sheets"
-	// The local file path where the content will be saved.
-	localFilePath := "ipcol.html"
-	// Check if the local file already exists.
-	if !fileExists(localFilePath) {
-		// Check if the remote URL is valid.
-		if isUrlValid(remoteFileURL) {
-			// Get the content from the remote URL.
-			data := getDataFromURL(remoteFileURL)
-			// Write the content to a local file.
-			writeToFile(localFilePath, data)
-		}
-	}
-	outputDir := "PDFs/" // Directory to store downloaded PDFs
-	// Check if its exists.
-	if !directoryExists(outputDir) {
-		// Create the dir
-		createDirectory(outputDir, 0o755)
-	}
-	// If the file exists, you can read it or process it as needed.
-	if fileExists(localFilePath) {
-		// Read the file content as a string.
-		content := readAFileAsString(localFilePath)
-		// Extract the links from the content.
-		pdfLinks := extractPDFLinks(content)
-		// Remove duplicates from the extracted links.
-		pdfLinks = removeDuplicatesFromSlice(pdfLinks)
-		// Download each PDF link concurrently.
-		for _, link := range pdfLinks {
-			// Download the PDF file.
-			downloadPDF(link, outputDir)
+	// Time the whole run for the summary.
+	started := time.Now()
+	// Read the settings: defaults, then the -config file, then the command line.
+	// Bad flags exit with exitUsage like any other bad setting, not the flag package's 2.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	config, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		if !errors.Is(err, errInvalidFlags) {
+			fmt.Fprintln(os.Stderr, err)
 		}
+		os.Exit(exitUsage)
 	}
-}
-
-// downloadPDF downloads a PDF from the given URL and saves it in the specified output directory.
-// It uses a WaitGroup to support concurrent execution and returns true if the download succeeded.
-func downloadPDF(finalURL, outputDir string) {
-	// Sanitize the URL to generate a safe file name
-	filename := strings.ToLower(urlToFilename(finalURL))
-
-	// Construct the full file path in the output directory
-	filePath := filepath.Join(outputDir, filename)
-
-	// Skip if the file already exists
-	if fileExists(filePath) {
-		log.Printf("file already exists, skipping: %s", filePath)
+	// Configure logging before anything else gets logged.
+	if err := setupLogger(config.LogLevel, config.LogJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	// Comparing two manifests needs neither the network nor the output directory.
+	if config.Diff {
+		if flag.NArg() != 2 {
+			slog.Error("-diff needs two manifests: -diff old.json new.json")
+			os.Exit(exitUsage)
+		}
+		if err := runDiff(os.Stdout, flag.Arg(0), flag.Arg(1)); err != nil {
+			slog.Error("unable to compare manifests", "error", err)
+			os.Exit(1)
+		}
 		return
 	}
-
-	// Create an HTTP client with a timeout
-	client := &http.Client{Timeout: 30 * time.Second}
-
-	// Send GET request
-	resp, err := client.Get(finalURL)
+	// An empty output directory would scatter files into the working directory.
+	if strings.TrimSpace(config.OutputDir) == "" {
+		slog.Error("the output directory must not be empty")
+		os.Exit(exitUsage)
+	}
+	// A negative retry count makes no sense.
+	if config.Retries < 0 {
+		slog.Error("-retries must not be negative", "retries", config.Retries)
+		os.Exit(exitUsage)
+	}
+	// Compile the URL filters up front so a typo fails before any network traffic.
+	include, err := compileOptionalRegexp(config.Include)
 	if err != nil {
-		log.Printf("failed to download %s: %v", finalURL, err)
-		return
+		slog.Error("invalid -include pattern", "error", err)
+		os.Exit(exitUsage)
 	}
-	defer resp.Body.Close()
-
-	// Check HTTP response status
-	if resp.StatusCode != http.StatusOK {
-		// Print the error since its not valid.
-		log.Printf("download failed for %s: %s", finalURL, resp.Status)
-		return
+	exclude, err := compileOptionalRegexp(config.Exclude)
+	if err != nil {
+		slog.Error("invalid -exclude pattern", "error", err)
+		os.Exit(exitUsage)
 	}
-	// Check Content-Type header
-	contentType := resp.Header.Get("Content-Type")
-	// Check if its pdf content type and if not than print a error.
-	if !strings.Contains(contentType, "application/pdf") {
-		// Print a error if the content type is invalid.
-		log.Printf("invalid content type for %s: %s (expected application/pdf)", finalURL, contentType)
-		return
+	linkPattern, err := compileOptionalRegexp(config.Pattern)
+	if err != nil {
+		slog.Error("invalid -pattern", "error", err)
+		os.Exit(exitUsage)
+	}
+	// Only the known layouts make sense; anything else is probably a typo.
+	if !slices.Contains([]string{download.LayoutFlat, download.LayoutHash, download.LayoutHost}, config.Layout) {
+		slog.Error("invalid -layout: expected flat, hash or host", "layout", config.Layout)
+		os.Exit(exitUsage)
+	}
+	if config.SummaryFormat != summaryText && config.SummaryFormat != summaryJSON {
+		slog.Error("invalid -summary-format: expected text or json", "summary_format", config.SummaryFormat)
+		os.Exit(exitUsage)
 	}
-	// Read the response body into memory first
-	var buf bytes.Buffer
-	// Copy it from the buffer to the file.
-	written, err := io.Copy(&buf, resp.Body)
-	// Print the error if errors are there.
+	since, err := parseSince(config.Since)
 	if err != nil {
-		log.Printf("failed to read PDF data from %s: %v", finalURL, err)
-		return
+		slog.Error(err.Error())
+		os.Exit(exitUsage)
+	}
+	// Cancel in-flight work on Ctrl-C or SIGTERM so partial files are cleaned up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The downloads in flight get a moment to finish before the reports are written, but a
+	// second Ctrl-C quits at once.
+	context.AfterFunc(ctx, stop)
+	// Give up on whatever is left once the run has taken too long. The downloads stop early
+	// enough that the ones in flight can use their grace period and still end within the limit.
+	grace := interruptGrace
+	if config.RunTimeout > 0 {
+		grace = min(grace, time.Duration(config.RunTimeout)/2)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.RunTimeout)-grace)
+		defer cancel()
 	}
-	// If 0 bytes are written than show an error and return it.
-	if written == 0 {
-		log.Printf("downloaded 0 bytes for %s; not creating file", finalURL)
+	// Checking the files already saved needs no network, so it happens instead of a run.
+	if config.Verify {
+		checked, problems, err := download.Verify(ctx, config.OutputDir, config.HashWorkers)
+		if err != nil {
+			slog.Error("unable to verify checksums", "error", err)
+			os.Exit(1)
+		}
+		for _, problem := range problems {
+			slog.Error("checksum verification failed", "path", problem.Path, "reason", problem.Reason)
+		}
+		slog.Info("checksums verified", "files", checked, "failed", len(problems))
+		if len(problems) > 0 {
+			os.Exit(exitChecksumMismatch)
+		}
 		return
 	}
-	// Only now create the file and write to disk
-	out, err := os.Create(filePath)
-	// Failed to create the file.
+	// Gather the listing pages to scan, falling back to the main safety data sheet page.
+	seedURLs := config.URLs
+	// A file that can't be read must not fall back to the default listing.
+	if config.URLsFile != "" {
+		listed, err := readURLsFile(config.URLsFile)
+		if err != nil {
+			slog.Error("unable to read -urls-file", "error", err)
+			os.Exit(exitUsage)
+		}
+		seedURLs = append(seedURLs, listed...)
+	}
+	if len(seedURLs) == 0 {
+		seedURLs = []string{defaultSeedURL}
+	}
+	// One client is shared by every request so connections are reused.
+	client, err := newHTTPClient(time.Duration(config.Timeout), time.Duration(config.ConnectTimeout), time.Duration(config.HeaderTimeout), config.Proxy, config.Resolver, config.IPVersion)
 	if err != nil {
-		log.Printf("failed to create file for %s: %v", finalURL, err)
-		return
+		slog.Error("unable to set up the HTTP client", "error", err)
+		os.Exit(exitUsage)
 	}
-	// Close the file.
-	defer out.Close()
-	// Write the buffer and if there is an error print it.
-	_, err = buf.WriteTo(out)
+	// Cookies set while fetching the listings, such as a session cookie the CDN checks, go
+	// along with the downloads.
+	cookies := newCookieStore()
+	if config.Cookies != "" {
+		if err := cookies.load(config.Cookies); err != nil {
+			slog.Error("unable to load cookies", "error", err)
+			os.Exit(exitUsage)
+		}
+	}
+	client.Jar = cookies
+	authorization, err := authorizationHeader(config.BasicAuth, config.BearerToken)
 	if err != nil {
-		log.Printf("failed to write PDF to file for %s: %v", finalURL, err)
-		return
+		slog.Error(err.Error())
+		os.Exit(exitUsage)
+	}
+	headers, err := parseHeaders(config.Headers)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(exitUsage)
+	}
+	// The listing pages and the downloads share one session, and with it robots.txt and the rate limits.
+	session := download.NewSession(download.HTTPOptions{
+		Client:        client,
+		UserAgent:     config.UserAgent,
+		Retries:       config.Retries,
+		Rate:          config.Rate,
+		PerHost:       config.PerHost,
+		Jitter:        time.Duration(config.Jitter),
+		Authorization: authorization,
+		AuthHosts:     authHosts(seedURLs, config.InputFile, config.BaseURL, config.AuthHosts),
+		Headers:       headers,
+		IgnoreRobots:  config.IgnoreRobots,
+	})
+	// Settings for the PDF downloads on top of the HTTP ones.
+	downloads := download.Options{
+		Session:       session,
+		Concurrency:   config.Concurrency,
+		Checksums:     config.Checksums,
+		MaxSize:       config.MaxSize,
+		MinSize:       config.MinSize,
+		MaxBandwidth:  config.MaxBandwidth,
+		Quiet:         config.Quiet,
+		Refresh:       config.Refresh,
+		Force:         config.Force,
+		HashNames:     config.HashNames,
+		Strict:        config.Strict,
+		AnyDocument:   linkPattern != nil,
+		Since:         since,
+		Layout:        config.Layout,
+		PostCommand:   strings.Fields(config.PostCommand),
+		SlowThreshold: time.Duration(config.SlowThreshold),
+		ValidatePDF:   config.ValidatePDF,
+		MaxFiles:      config.MaxFiles,
+		ExtractZips:   config.ExtractZips,
+		Grace:         grace,
+		Claimed:       &download.URLSet{},
+	}
+	// Publish the files somewhere besides the output directory when asked.
+	downloads.Sink, err = download.NewSink(config.Sink, config.S3Endpoint, config.S3Region)
+	if err != nil {
+		slog.Error("unable to set up the sink", "error", err)
+		os.Exit(exitUsage)
 	}
-	// Return a true since everything went correctly.
-	log.Printf("successfully downloaded %d bytes: %s → %s", written, finalURL, filePath)
+	outputDir := config.OutputDir
+	// Check if its exists; a dry run or link listing never writes to it.
+	if !config.DryRun && !config.PrintLinks {
+		exists, err := fsutil.DirectoryExists(outputDir)
+		if err != nil {
+			slog.Error("unable to check output directory", "error", err)
+			os.Exit(1)
+		}
+		// Create the dir, including any missing parents, and stop if there is nowhere to save the files.
+		if !exists {
+			if err := fsutil.CreateDirectory(outputDir, 0o755); err != nil {
+				slog.Error("unable to create output directory", "error", err)
+				os.Exit(1)
+			}
+		}
+		// Find out now, not after fetching every listing, if nothing can be saved there.
+		if err := fsutil.CheckWritable(outputDir); err != nil {
+			slog.Error("unable to use output directory", "error", err)
+			os.Exit(1)
+		}
+		// Remember what earlier runs downloaded, even if those files have since been archived.
+		downloads.Index, err = download.LoadIndex(filepath.Join(outputDir, download.IndexFileName))
+		if err != nil {
+			slog.Error("unable to load the download index", "error", err)
+			os.Exit(1)
+		}
+		downloads.IgnoreIndex = config.IgnoreIndex
+	}
+	// Extract the PDF links from every listing page and merge them.
+	crawl := download.Crawl{
+		MaxPages:    config.MaxPages,
+		MaxDepth:    config.Depth,
+		CacheTTL:    time.Duration(config.CacheTTL),
+		LinkPattern: linkPattern,
+		Concurrency: config.Concurrency,
+		Zips:        config.ExtractZips,
+		Claimed:     downloads.Claimed,
+	}
+	// Reuse the links found by an earlier run over the same listings while they are fresh.
+	source := crawl.Source(seedURLs)
+	pdfLinks, cached := []string(nil), false
+	if config.InputFile != "" {
+		// A page saved from a browser replaces the crawl, so nothing is fetched to find links.
+		pdfLinks, err = download.LinksFromFile(crawl, config.InputFile, config.BaseURL)
+		if err != nil {
+			slog.Error("unable to read -input-file", "error", err)
+			os.Exit(exitUsage)
+		}
+	} else if config.LinksCache != "" && !config.RefreshLinks {
+		pdfLinks, cached = download.LoadLinksCache(config.LinksCache, source, crawl.CacheTTL)
+	}
+	var listingErr error
+	switch {
+	case config.InputFile != "":
+		slog.Info("extracted links from local file", "path", config.InputFile, "links", len(pdfLinks))
+	case cached:
+		slog.Info("using cached links", "path", config.LinksCache, "links", len(pdfLinks))
+	default:
+		pdfLinks, listingErr = session.CollectLinks(ctx, crawl, seedURLs)
+		if listingErr != nil {
+			slog.Error("unable to load every listing page", "error", listingErr)
+		} else if config.LinksCache != "" {
+			// Only a complete set is worth reusing.
+			if err := download.SaveLinksCache(config.LinksCache, source, pdfLinks); err != nil {
+				slog.Error("unable to cache links", "error", err)
+			}
+		}
+	}
+	// Nothing to download usually means the site changed, not that it has no documents.
+	if len(pdfLinks) == 0 && listingErr == nil {
+		if config.FailOnEmpty {
+			slog.Error("no links were extracted (-fail-on-empty)")
+			os.Exit(exitNoLinks)
+		}
+		slog.Warn("no links were extracted, nothing will be downloaded")
+	}
+	// Keep only the links the user asked for.
+	pdfLinks = extract.FilterLinks(pdfLinks, include, exclude)
+	// Make the order reproducible from run to run when asked.
+	if config.Sort {
+		pdfLinks = extract.RemoveDuplicatesFromSliceSorted(pdfLinks)
+	}
+	// Name files after the last segment of their URL where that is unambiguous.
+	if config.FlattenNames {
+		downloads.FlatNames = download.FlatNames(pdfLinks)
+	}
+	// Point out links that would end up in the same file before any of them is downloaded.
+	if !config.PrintLinks {
+		warnFilenameCollisions(downloads, pdfLinks)
+	}
+	// Hand the bare list to another tool instead of downloading.
+	if config.PrintLinks {
+		printLinkList(pdfLinks)
+		os.Exit(runExitCode(nil, listingErr))
+	}
+	// Size up the batch first when asked, so a big crawl can be reconsidered. It goes to stderr
+	// with the logs, so stdout holds nothing but the summary a script may parse.
+	if config.Preflight {
+		fmt.Fprintln(os.Stderr, describeBatch(session.Preflight(ctx, pdfLinks, config.Concurrency)))
+	}
+	// Only show what would happen when doing a dry run.
+	if config.DryRun {
+		printDryRun(downloads, pdfLinks, outputDir)
+		os.Exit(runExitCode(nil, listingErr))
+	}
+	// Checkpoint the batch as it goes, and with -resume pick up where the last run stopped.
+	state, pending, err := loadBatchState(filepath.Join(outputDir, stateFileName), pdfLinks, config.Resume)
+	if err != nil {
+		slog.Error("unable to load the batch state", "error", err)
+		os.Exit(1)
+	}
+	if done := len(pdfLinks) - len(pending); done > 0 {
+		slog.Info("resuming batch", "already_done", done, "remaining", len(pending))
+	}
+	if err := state.save(); err != nil {
+		slog.Warn("unable to write checkpoint", "error", err)
+	}
+	// Download each PDF link concurrently.
+	results := downloadWorkerPool(ctx, downloads, pending, outputDir, state, config.QuietSkip)
+	if err := state.save(); err != nil {
+		slog.Error("unable to write checkpoint", "error", err)
+	}
+	// Results arrive in completion order; sort them too so the reports are diffable.
+	if config.Sort {
+		slices.SortFunc(results, func(a, b download.Result) int {
+			return strings.Compare(a.URL, b.URL)
+		})
+	}
+	// Let the user know if the run was cut short.
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("run timeout reached before all links were processed", "run_timeout", time.Duration(config.RunTimeout), "processed", len(results), "total", len(pdfLinks))
+	} else if ctx.Err() != nil {
+		slog.Warn("interrupted before all links were processed", "processed", len(results), "total", len(pdfLinks))
+	}
+	// Add this run's downloads to the persistent index.
+	if err := downloads.Index.Save(); err != nil {
+		slog.Error("unable to save the download index", "error", err)
+	}
+	// Keep the session for the next run.
+	if config.Cookies != "" {
+		if err := cookies.save(config.Cookies); err != nil {
+			slog.Error("unable to save cookies", "error", err)
+		}
+	}
+	// Record what this run downloaded or found already saved. A resumed run skipped the links
+	// finished before, so keep what the previous manifest says about them.
+	manifestPath := filepath.Join(outputDir, download.ManifestFileName)
+	records := download.ManifestRecords(results, downloads.Index, outputDir)
+	if len(pending) < len(pdfLinks) {
+		records, err = resumedManifest(manifestPath, records, pdfLinks, pending)
+		if err != nil {
+			slog.Warn("unable to carry over the previous manifest", "error", err)
+		}
+		if config.Sort {
+			slices.SortFunc(records, func(a, b download.Record) int {
+				return strings.Compare(a.URL, b.URL)
+			})
+		}
+	}
+	if err := download.WriteManifest(manifestPath, records); err != nil {
+		slog.Error("unable to write manifest", "error", err)
+	}
+	// Write the spreadsheet friendly report next to the JSON manifest.
+	if config.Report != "" {
+		if err := writeCSVReport(config.Report, results); err != nil {
+			slog.Error("unable to write report", "error", err)
+		}
+	}
+	// Summarize what went wrong, keeping skipped files separate from real failures.
+	logDownloadSummary(results)
+	summary := summarize(len(pdfLinks), results, time.Since(started))
+	if config.SummaryFormat == summaryJSON {
+		if err := summary.writeJSON(os.Stdout); err != nil {
+			slog.Error("unable to write summary", "error", err)
+		}
+	} else {
+		summary.writeText(os.Stdout)
+	}
+	// Let scripts and cron jobs tell a clean run from a broken one.
+	os.Exit(runExitCode(results, listingErr))
 }
 
-// Checks if the directory exists
-// If it exists, return true.
-// If it doesn't, return false.
-func directoryExists(path string) bool {
-	directory, err := os.Stat(path)
-	if err != nil {
-		return false
+// interruptGrace is how long the downloads in flight may finish after Ctrl-C or -run-timeout.
+// With a -run-timeout shorter than twice this, they get half of it.
+const interruptGrace = 10 * time.Second
+
+// Exit codes of a finished run.
+const (
+	exitOK                = 0  // everything was downloaded or deliberately skipped
+	exitDownloadsFailed   = 1  // at least one download failed
+	exitListingFetchError = 2  // a listing page could not be loaded
+	exitNoLinks           = 3  // the listings loaded but held no links (-fail-on-empty)
+	exitChecksumMismatch  = 4  // -verify found files that no longer match their checksums
+	exitUsage             = 64 // the flags or the configuration are invalid (EX_USAGE from sysexits.h)
+)
+
+// runExitCode returns the exit code for a run that produced results. An unavailable
+// listing outranks failed downloads because it means PDFs may be missing unnoticed.
+func runExitCode(results []download.Result, listingErr error) int {
+	if listingErr != nil {
+		return exitListingFetchError
+	}
+	for _, result := range results {
+		if downloadOutcome(result.Err) == "failed" {
+			return exitDownloadsFailed
+		}
 	}
-	return directory.IsDir()
+	return exitOK
 }
 
-// The function takes two parameters: path and permission.
-// We use os.Mkdir() to create the directory.
-// If there is an error, we use log.Println() to log the error and then exit the program.
-func createDirectory(path string, permission os.FileMode) {
-	err := os.Mkdir(path, permission)
+// setupLogger installs the default slog logger writing to stderr at the given level,
+// as JSON when asJSON is set and as text otherwise.
+func setupLogger(level string, asJSON bool) error {
+	var minimum slog.Level
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid -log-level %q: %w", level, err)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: minimum}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	if asJSON {
+		handler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// defaultSeedURL is the listing page scanned when no -url is given.
+const defaultSeedURL = "https://ipcol.com/safety-data-sheets"
+
+// readURLsFile returns the URLs listed one per line in path, ignoring blank lines and # comments.
+func readURLsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Println(err)
+		return nil, fmt.Errorf("read URLs file: %w", err)
 	}
+	var urls []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, nil
 }
 
-// extractPDFLinks scans htmlContent line by line and returns all unique .pdf URLs.
-func extractPDFLinks(htmlContent string) []string {
-	// Regex to match http(s) URLs ending in .pdf (with optional query/fragments)
-	pdfRegex := regexp.MustCompile(`https?://[^\s"'<>]+?\.pdf(?:\?[^\s"'<>]*)?`)
+// printDryRun prints every link with the path it would be saved to, followed by the count.
+func printDryRun(options download.Options, links []string, outputDir string) {
+	for _, link := range links {
+		fmt.Printf("%s → %s\n", link, filepath.Join(outputDir, options.Path(link)))
+	}
+	fmt.Printf("dry run: %d PDF links found, nothing downloaded\n", len(links))
+}
 
-	seen := make(map[string]struct{})
-	var links []string
+// printLinkList writes one link per line to stdout. Logs go to stderr, so the output can
+// be piped straight into other tools.
+func printLinkList(links []string) {
+	for _, link := range links {
+		fmt.Println(link)
+	}
+}
 
-	// Process each line separately
-	for _, line := range strings.Split(htmlContent, "\n") {
-		for _, match := range pdfRegex.FindAllString(line, -1) {
-			if _, ok := seen[match]; !ok {
-				seen[match] = struct{}{}
-				links = append(links, match)
-			}
+// logDownloadSummary logs why every link that wasn't downloaded was skipped or failed.
+func logDownloadSummary(results []download.Result) {
+	for _, result := range results {
+		switch {
+		case result.Err == nil:
+		case errors.Is(result.Err, download.ErrAlreadyExists):
+			slog.Debug("skipped", "reason", result.Err)
+		case download.IsSkip(result.Err):
+			slog.Info("skipped", "reason", result.Err)
+		case errors.Is(result.Err, download.ErrSoft404):
+			slog.Warn("document missing", "error", result.Err)
+		default:
+			slog.Warn("download failed", "error", result.Err)
 		}
 	}
+}
 
-	return links
+// runSummary holds the headline numbers of a run.
+type runSummary struct {
+	linksFound     int               // links left after extraction, deduplication and filtering
+	downloaded     int               // files saved in this run
+	alreadyPresent int               // files skipped because they were already on disk
+	otherSkipped   int               // files skipped for another reason, e.g. robots.txt or size
+	failed         int               // files that could not be downloaded
+	bytes          int64             // bytes saved in this run
+	elapsed        time.Duration     // wall time of the whole run
+	slowest        []download.Result // the longest downloads, slowest first
+	statusCodes    map[int]int       // how many downloads got each HTTP status code
 }
 
-// urlToFilename converts a URL into a filesystem-safe filename
-func urlToFilename(rawURL string) string {
-	parsed, err := url.Parse(rawURL) // Parse the URL
-	// Print the errors if any.
-	if err != nil {
-		log.Println(err) // Log error
-		return ""        // Return empty string on error
+// Formats of the run summary.
+const (
+	summaryText = "text"
+	summaryJSON = "json"
+)
+
+// slowestShown is how many of the slowest downloads the summary lists.
+const slowestShown = 5
+
+// summarize adds up the results of a run.
+func summarize(linksFound int, results []download.Result, elapsed time.Duration) runSummary {
+	summary := runSummary{linksFound: linksFound, elapsed: elapsed, statusCodes: make(map[int]int)}
+	for _, result := range results {
+		// Downloads skipped before sending a request have no status.
+		if result.Record.StatusCode != 0 {
+			summary.statusCodes[result.Record.StatusCode]++
+		}
+		switch {
+		case result.Err == nil:
+			summary.downloaded++
+			summary.bytes += result.Bytes
+		case errors.Is(result.Err, download.ErrAlreadyExists):
+			summary.alreadyPresent++
+		case download.IsSkip(result.Err):
+			summary.otherSkipped++
+		default:
+			summary.failed++
+		}
+		// Skips return before any transfer, so only the downloads that ran are worth ranking.
+		if !download.IsSkip(result.Err) {
+			summary.slowest = append(summary.slowest, result)
+		}
 	}
-	filename := parsed.Host // Start with host name
-	// Parse the path and if its not empty replace them with valid characters.
-	if parsed.Path != "" {
-		filename += "_" + strings.ReplaceAll(parsed.Path, "/", "_") // Append path
+	slices.SortStableFunc(summary.slowest, func(a, b download.Result) int {
+		return cmp.Compare(b.Elapsed, a.Elapsed)
+	})
+	summary.slowest = summary.slowest[:min(len(summary.slowest), slowestShown)]
+	return summary
+}
+
+// writeText prints the summary as an aligned block.
+func (summary runSummary) writeText(writer io.Writer) {
+	fmt.Fprintln(writer, "Run summary")
+	fmt.Fprintf(writer, "  links found:      %d\n", summary.linksFound)
+	fmt.Fprintf(writer, "  downloaded:       %d (%s)\n", summary.downloaded, formatBytes(summary.bytes))
+	fmt.Fprintf(writer, "  already present:  %d\n", summary.alreadyPresent)
+	fmt.Fprintf(writer, "  skipped (other):  %d\n", summary.otherSkipped)
+	fmt.Fprintf(writer, "  failed:           %d\n", summary.failed)
+	fmt.Fprintf(writer, "  elapsed:          %s\n", summary.elapsed.Round(time.Millisecond))
+	if len(summary.statusCodes) > 0 {
+		fmt.Fprintf(writer, "  status codes:     %s\n", formatStatusCodes(summary.statusCodes))
 	}
-	if parsed.RawQuery != "" {
-		filename += "_" + strings.ReplaceAll(parsed.RawQuery, "&", "_") // Append query
+	if len(summary.slowest) > 0 {
+		fmt.Fprintln(writer, "  slowest:")
+		for _, result := range summary.slowest {
+			fmt.Fprintf(writer, "    %10s  %s\n", result.Elapsed.Round(time.Millisecond), result.URL)
+		}
 	}
-	invalidChars := []string{`"`, `\`, `/`, `:`, `*`, `?`, `<`, `>`, `|`} // Define illegal filename characters
-	// Loop over the invalid characters and replace them.
-	for _, char := range invalidChars {
-		filename = strings.ReplaceAll(filename, char, "_") // Replace each with underscore
+}
+
+// summaryDocument is the summary as written by -summary-format json.
+type summaryDocument struct {
+	LinksFound     int               `json:"links_found"`
+	Downloaded     int               `json:"downloaded"`
+	AlreadyPresent int               `json:"already_present"`
+	OtherSkipped   int               `json:"skipped_other"`
+	Failed         int               `json:"failed"`
+	Bytes          int64             `json:"bytes"`
+	ElapsedSeconds float64           `json:"elapsed_seconds"`
+	StatusCodes    map[int]int       `json:"status_codes"` // keyed by the code as a string, e.g. "200"
+	Slowest        []summaryTransfer `json:"slowest"`
+}
+
+// summaryTransfer is one of the slowest downloads in a summaryDocument.
+type summaryTransfer struct {
+	URL            string  `json:"url"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// writeJSON prints the summary as a single JSON object on one line, for scripts to parse.
+func (summary runSummary) writeJSON(writer io.Writer) error {
+	document := summaryDocument{
+		LinksFound:     summary.linksFound,
+		Downloaded:     summary.downloaded,
+		AlreadyPresent: summary.alreadyPresent,
+		OtherSkipped:   summary.otherSkipped,
+		Failed:         summary.failed,
+		Bytes:          summary.bytes,
+		ElapsedSeconds: summary.elapsed.Seconds(),
+		StatusCodes:    summary.statusCodes,
+		Slowest:        []summaryTransfer{},
 	}
-	if getFileExtension(filename) != ".pdf" {
-		filename = filename + ".pdf"
+	for _, result := range summary.slowest {
+		document.Slowest = append(document.Slowest, summaryTransfer{URL: result.URL, ElapsedSeconds: result.Elapsed.Seconds()})
 	}
-	return strings.ToLower(filename) // Return sanitized filename
+	return json.NewEncoder(writer).Encode(document)
 }
 
-// Get the file extension of a file
-func getFileExtension(path string) string {
-	return filepath.Ext(path)
+// formatStatusCodes renders status code counts in code order, e.g. "200: 142, 404: 3, 503: 1".
+func formatStatusCodes(counts map[int]int) string {
+	var parts []string
+	for _, code := range slices.Sorted(maps.Keys(counts)) {
+		parts = append(parts, fmt.Sprintf("%d: %d", code, counts[code]))
+	}
+	return strings.Join(parts, ", ")
 }
 
-// Read a file and return the contents
-func readAFileAsString(path string) string {
-	content, err := os.ReadFile(path)
-	if err != nil {
-		log.Println(err)
+// formatBytes renders a byte count with a binary unit, e.g. 1.5 MiB.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
 	}
-	return string(content)
+	divisor, exponent := int64(unit), 0
+	for remaining := size / unit; remaining >= unit; remaining /= unit {
+		divisor *= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(divisor), "KMGTPE"[exponent])
 }
 
-// Check if the given url is valid.
-func isUrlValid(uri string) bool {
-	_, err := url.ParseRequestURI(uri)
-	return err == nil
+// downloadOutcome classifies a result as downloaded, skipped or failed.
+func downloadOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "downloaded"
+	case download.IsSkip(err):
+		return "skipped"
+	default:
+		return "failed"
+	}
 }
 
-/*
-It checks if the file exists
-If the file exists, it returns true
-If the file does not exist, it returns false
-*/
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
+// writeCSVReport writes one row per processed link to path.
+func writeCSVReport(path string, results []download.Result) error {
+	file, err := os.Create(path)
 	if err != nil {
-		return false
+		return fmt.Errorf("write report %s: %w", path, err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	rows := [][]string{{"source_url", "saved_filename", "http_status", "content_type", "bytes", "outcome"}}
+	for _, result := range results {
+		outcome := downloadOutcome(result.Err)
+		// Only name a file when one is actually on disk.
+		savedFilename := ""
+		if result.Path != "" {
+			savedFilename = result.Record.Filename
+		}
+		status := ""
+		if result.Record.StatusCode != 0 {
+			status = strconv.Itoa(result.Record.StatusCode)
+		}
+		rows = append(rows, []string{
+			result.URL,
+			savedFilename,
+			status,
+			result.Record.ContentType,
+			strconv.FormatInt(result.Record.Size, 10),
+			outcome,
+		})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return fmt.Errorf("write report %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write report %s: %w", path, err)
 	}
-	return !info.IsDir()
+	return nil
 }
 
-/*
-It takes in a path and content to write to that file.
-It uses the os.WriteFile function to write the content to that file.
-It checks for errors and logs them.
-*/
-func writeToFile(path string, content []byte) {
-	err := os.WriteFile(path, content, 0644)
-	if err != nil {
-		log.Println(err)
+// downloadWorkerPool downloads every link into outputDir, options.Concurrency at a time, and
+// checkpoints each outcome in state. It blocks until all links have been processed, or ctx is
+// cancelled, and returns the result of every link that was processed.
+func downloadWorkerPool(ctx context.Context, options download.Options, links []string, outputDir string, state *batchState, quietSkip bool) []download.Result {
+	// Gather the results as they come in, reporting progress after each one.
+	progress := &batchProgress{total: len(links)}
+	var collected []download.Result
+	for result := range download.Download(ctx, links, outputDir, options) {
+		collected = append(collected, result)
+		state.record(result.URL, result.Err)
+		progress.record(result.Err)
+		// With -quiet-skip a file already on disk doesn't get a progress line of its own, so
+		// an incremental run only shows what changed.
+		level := slog.LevelInfo
+		if quietSkip && errors.Is(result.Err, download.ErrAlreadyExists) {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, progress.String())
 	}
+	return collected
 }
 
-// Send a http get request to a given url and return the data from that url.
-func getDataFromURL(uri string) []byte {
-	response, err := http.Get(uri)
-	if err != nil {
-		log.Println(err)
+// batchProgress counts finished downloads for the running progress line.
+// It is safe for concurrent use.
+type batchProgress struct {
+	total      int
+	downloaded atomic.Int64
+	skipped    atomic.Int64
+	failed     atomic.Int64
+}
+
+// record counts one finished link.
+func (progress *batchProgress) record(err error) {
+	switch {
+	case err == nil:
+		progress.downloaded.Add(1)
+	case download.IsSkip(err):
+		progress.skipped.Add(1)
+	default:
+		progress.failed.Add(1)
 	}
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		log.Println(err)
+}
+
+// String formats the progress as "downloaded X of N (Y skipped, Z failed)".
+func (progress *batchProgress) String() string {
+	return fmt.Sprintf("downloaded %d of %d (%d skipped, %d failed)",
+		progress.downloaded.Load(), progress.total, progress.skipped.Load(), progress.failed.Load())
+}
+
+// describeBatch describes what -preflight found out, such as "about to download 12 files
+// totaling 3.4 MiB (2 of unknown size)".
+func describeBatch(size download.BatchSize) string {
+	text := fmt.Sprintf("about to download %d files totaling %s", size.Files, formatBytes(size.Bytes))
+	if size.Unknown > 0 {
+		text += fmt.Sprintf(" (%d of unknown size)", size.Unknown)
 	}
-	err = response.Body.Close()
+	return text
+}
+
+// parseSince reads a -since cutoff given as an RFC 3339 timestamp or a YYYY-MM-DD date.
+// An empty value means no cutoff.
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if cutoff, err := time.Parse(time.RFC3339, value); err == nil {
+		return cutoff, nil
+	}
+	cutoff, err := time.Parse(time.DateOnly, value)
 	if err != nil {
-		log.Println(err)
+		return time.Time{}, fmt.Errorf("invalid -since %q: expected YYYY-MM-DD or an RFC 3339 timestamp", value)
+	}
+	return cutoff, nil
+}
+
+// warnFilenameCollisions logs a warning for every file name more than one link would be saved
+// under, so the clash can be fixed with -hash-names before anything is lost.
+func warnFilenameCollisions(options download.Options, links []string) {
+	collisions := options.Collisions(links)
+	for _, name := range slices.Sorted(maps.Keys(collisions)) {
+		slog.Warn("links share a file name, only one of them will be saved", "filename", name, "urls", collisions[name])
+	}
+	if len(collisions) > 0 && !options.HashNames {
+		slog.Warn("use -hash-names to give every link a file of its own", "collisions", len(collisions))
+	}
+}
+
+// parseHeaders turns -header values of the form "Name: value" into a header set. The errors
+// name the header but never echo its value.
+func parseHeaders(lines []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid -header %q: expected \"Name: value\"", name)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// authorizationHeader returns the Authorization header value for -basic-auth (user:pass) or
+// -bearer-token, or an empty string when neither is set. The errors never echo the secrets.
+func authorizationHeader(basicAuth, bearerToken string) (string, error) {
+	switch {
+	case basicAuth != "" && bearerToken != "":
+		return "", errors.New("-basic-auth and -bearer-token can't be used together")
+	case basicAuth != "":
+		if !strings.Contains(basicAuth, ":") {
+			return "", errors.New("-basic-auth must have the form user:pass")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(basicAuth)), nil
+	case bearerToken != "":
+		return "Bearer " + bearerToken, nil
+	}
+	return "", nil
+}
+
+// authHosts returns the hosts the credentials may be sent to: those of the listing pages, the
+// -base-url host when the links come from an -input-file, and the extra hosts given.
+func authHosts(seedURLs []string, inputFile, baseURL string, extra []string) []string {
+	pages := slices.Clone(seedURLs)
+	if inputFile != "" {
+		pages = append(pages, baseURL)
+	}
+	var hosts []string
+	for _, page := range pages {
+		if parsed, err := url.Parse(page); err == nil && parsed.Hostname() != "" {
+			hosts = append(hosts, parsed.Hostname())
+		}
 	}
-	return body
+	return append(hosts, extra...)
 }
 
-// Remove all the duplicates from a slice and return the slice.
-func removeDuplicatesFromSlice(slice []string) []string {
-	check := make(map[string]bool)
-	var newReturnSlice []string
-	for _, content := range slice {
-		if !check[content] {
-			check[content] = true
-			newReturnSlice = append(newReturnSlice, content)
+// newHTTPClient builds the client shared by all requests. The connect and header timeouts
+// make a dead server fail fast, while the overall timeout bounds a slow but steady download.
+// Requests go through proxyURL when set, and otherwise through the proxy named by the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Host names are looked up with
+// the DNS server at resolverAddress when set, and connections only use IPv4 or IPv6 when
+// ipVersion is "4" or "6"; empty values leave both to the system.
+func newHTTPClient(timeout, connectTimeout, headerTimeout time.Duration, proxyURL, resolverAddress, ipVersion string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		proxy, err := url.Parse(proxyURL)
+		if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: expected something like http://proxy.example.com:8080", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if resolverAddress != "" {
+		// A bare address means the standard DNS port.
+		if _, _, err := net.SplitHostPort(resolverAddress); err != nil {
+			resolverAddress = net.JoinHostPort(resolverAddress, "53")
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: connectTimeout}).DialContext(ctx, network, resolverAddress)
+			},
 		}
 	}
-	return newReturnSlice
+	if ipVersion != "" && ipVersion != "4" && ipVersion != "6" {
+		return nil, fmt.Errorf("invalid IP version %q: expected 4 or 6", ipVersion)
+	}
+	// "tcp4" and "tcp6" only dial addresses of that version.
+	network := "tcp" + ipVersion
+	transport.DialContext = func(ctx context.Context, _, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = headerTimeout
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+// compileOptionalRegexp compiles pattern, returning nil for an empty pattern.
+func compileOptionalRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
 }
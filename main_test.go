@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/download"
+)
+
+func TestParseConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"concurrency": 3, "rate": 0.5, "cache_ttl": "1h", "urls": ["https://ipcol.com/a", "https://ipcol.com/b"]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := parseConfig(flags, []string{"-config", path, "-rate", "4", "-url", "https://ipcol.com/c"})
+	if err != nil {
+		t.Fatalf("parseConfig() error = %v", err)
+	}
+	// The file overrides the defaults, the flags override the file, and everything else keeps its default.
+	if config.Concurrency != 3 || time.Duration(config.CacheTTL) != time.Hour {
+		t.Errorf("file settings not applied: concurrency %d, cache TTL %s", config.Concurrency, time.Duration(config.CacheTTL))
+	}
+	if config.Rate != 4 {
+		t.Errorf("config.Rate = %v, want the flag value 4", config.Rate)
+	}
+	if want := []string{"https://ipcol.com/c"}; !slices.Equal(config.URLs, want) {
+		t.Errorf("config.URLs = %q, want %q", config.URLs, want)
+	}
+	if config.OutputDir != defaultConfig().OutputDir {
+		t.Errorf("config.OutputDir = %q, want the default %q", config.OutputDir, defaultConfig().OutputDir)
+	}
+}
+
+func TestParseConfigRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"concurency": 3}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := parseConfig(flags, []string{"-config", path}); err == nil {
+		t.Error("parseConfig() accepted a misspelled key")
+	}
+	// A bad flag is told apart from a bad file, since the flag set has already reported it.
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if _, err := parseConfig(flags, []string{"-concurency", "3"}); !errors.Is(err, errInvalidFlags) {
+		t.Errorf("parseConfig() of an unknown flag error = %v, want errInvalidFlags", err)
+	}
+}
+
+// pdfBody starts like a PDF, which is all the downloader checks before saving a file.
+const pdfBody = "%PDF-1.4\n% test document\n%%EOF\n"
+
+// newPDFServer serves a small PDF at every path but /missing.pdf, which is not found.
+func newPDFServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, pdfBody+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testDownloadOptions returns the download.Options of a run against server, two files at a time
+// and without asking for robots.txt.
+func testDownloadOptions(server *httptest.Server) download.Options {
+	session := download.NewSession(download.HTTPOptions{Client: server.Client(), IgnoreRobots: true})
+	return download.Options{Session: session, Concurrency: 2}
+}
+
+func TestReadURLsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.txt")
+	if err := os.WriteFile(path, []byte("# listings\nhttps://ipcol.com/a\n\n  https://ipcol.com/b  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	urls, err := readURLsFile(path)
+	if err != nil {
+		t.Fatalf("readURLsFile() error = %v", err)
+	}
+	if want := []string{"https://ipcol.com/a", "https://ipcol.com/b"}; !slices.Equal(urls, want) {
+		t.Errorf("readURLsFile() = %q, want %q", urls, want)
+	}
+	// A missing file is an error, not an empty list that would fall back to the default listing.
+	if _, err := readURLsFile(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readURLsFile() of a missing file error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	got, err := authorizationHeader("alice:s3cret", "")
+	if want := "Basic YWxpY2U6czNjcmV0"; err != nil || got != want {
+		t.Errorf("authorizationHeader() = %q, %v, want %q", got, err, want)
+	}
+	// Only one kind of credentials can be sent.
+	if _, err := authorizationHeader("alice:s3cret", "token"); err == nil {
+		t.Error("authorizationHeader() accepted both basic auth and a bearer token")
+	}
+	// The credentials go to the listing hosts, the -base-url host of an -input-file, and the -auth-host ones.
+	hosts := authHosts([]string{"https://ipcol.com/sds"}, "saved.html", "https://www.ipcol.com/", []string{"cdn.ipcol.com"})
+	if want := []string{"ipcol.com", "www.ipcol.com", "cdn.ipcol.com"}; !slices.Equal(hosts, want) {
+		t.Errorf("authHosts() = %q, want %q", hosts, want)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := parseHeaders([]string{"Referer: https://ipcol.com/sds", "X-Token:abc"})
+	if err != nil {
+		t.Fatalf("parseHeaders() error = %v", err)
+	}
+	if headers.Get("Referer") != "https://ipcol.com/sds" || headers.Get("X-Token") != "abc" {
+		t.Errorf("parseHeaders() = %v", headers)
+	}
+	if _, err := parseHeaders([]string{"no colon here"}); err == nil {
+		t.Error("parseHeaders() accepted a header without a colon")
+	}
+}
+
+func TestNewHTTPClientIPVersion(t *testing.T) {
+	server := newPDFServer(t) // listens on 127.0.0.1
+	for _, test := range []struct {
+		ipVersion string
+		wantErr   bool
+	}{
+		{"", false},
+		{"4", false},
+		{"6", true},
+	} {
+		client, err := newHTTPClient(time.Minute, time.Second, time.Second, "", "", test.ipVersion)
+		if err != nil {
+			t.Fatalf("newHTTPClient(%q) error = %v", test.ipVersion, err)
+		}
+		response, err := client.Get(server.URL + "/a.pdf")
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("GET over IP version %q: error = %v, want error %v", test.ipVersion, err, test.wantErr)
+		}
+	}
+	if _, err := newHTTPClient(time.Minute, time.Second, time.Second, "", "", "5"); err == nil {
+		t.Error("newHTTPClient() accepted IP version 5")
+	}
+}
+
+func TestDownloadWorkerPool(t *testing.T) {
+	server := newPDFServer(t)
+	outputDir := t.TempDir()
+	links := []string{
+		server.URL + "/a.pdf",
+		server.URL + "/b.pdf",
+		server.URL + "/missing.pdf",
+	}
+	state, _, err := loadBatchState(filepath.Join(outputDir, stateFileName), links, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := downloadWorkerPool(context.Background(), testDownloadOptions(server), links, outputDir, state, false)
+	if len(results) != len(links) {
+		t.Fatalf("got %d results, want %d", len(results), len(links))
+	}
+	downloaded := 0
+	for _, result := range results {
+		if result.Err == nil {
+			downloaded++
+		}
+	}
+	if downloaded != 2 {
+		t.Errorf("got %d successful downloads, want 2", downloaded)
+	}
+	// Every outcome is checkpointed, so a resumed batch only retries the failed link.
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, pending, err := loadBatchState(state.path, links, true); err != nil || !slices.Equal(pending, links[2:]) {
+		t.Errorf("pending after resume = %q, %v, want %q", pending, err, links[2:])
+	}
+}
+
+func TestSummarizeRanksSlowestDownloads(t *testing.T) {
+	results := []download.Result{
+		{URL: "https://ipcol.com/fast.pdf", Elapsed: time.Second},
+		{URL: "https://ipcol.com/present.pdf", Err: download.ErrAlreadyExists, Elapsed: time.Minute},
+		{URL: "https://ipcol.com/slow.pdf", Elapsed: 30 * time.Second},
+		{URL: "https://ipcol.com/broken.pdf", Err: download.ErrSoft404, Elapsed: 10 * time.Second},
+	}
+	summary := summarize(len(results), results, time.Minute)
+	var got []string
+	for _, result := range summary.slowest {
+		got = append(got, result.URL)
+	}
+	// Skipped links never transferred anything, so they aren't ranked.
+	want := []string{"https://ipcol.com/slow.pdf", "https://ipcol.com/broken.pdf", "https://ipcol.com/fast.pdf"}
+	if !slices.Equal(got, want) {
+		t.Errorf("slowest = %q, want %q", got, want)
+	}
+}
+
+func TestSummarizeCountsStatusCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone.pdf":
+			http.NotFound(w, r)
+		case "/busy.pdf":
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, pdfBody+r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	links := []string{server.URL + "/a.pdf", server.URL + "/b.pdf", server.URL + "/gone.pdf", server.URL + "/busy.pdf"}
+	results := downloadWorkerPool(context.Background(), testDownloadOptions(server), links, t.TempDir(), nil, false)
+
+	// Failed responses are counted too, including a server error that outlasted the retries.
+	got := formatStatusCodes(summarize(len(links), results, time.Second).statusCodes)
+	if want := "200: 2, 404: 1, 503: 1"; got != want {
+		t.Errorf("status codes = %q, want %q", got, want)
+	}
+}
+
+func TestSummaryWriteJSON(t *testing.T) {
+	results := []download.Result{
+		{URL: "https://ipcol.com/a.pdf", Bytes: 1500, Record: download.Record{Size: 1500, StatusCode: http.StatusOK}, Elapsed: 2 * time.Second},
+		{URL: "https://ipcol.com/b.pdf", Record: download.Record{StatusCode: http.StatusNotFound}, Err: errors.New("unexpected status"), Elapsed: time.Second},
+		{URL: "https://ipcol.com/c.pdf", Err: download.ErrAlreadyExists},
+	}
+	var output bytes.Buffer
+	if err := summarize(4, results, 90*time.Second).writeJSON(&output); err != nil {
+		t.Fatalf("writeJSON() error = %v", err)
+	}
+	// Scripts read one object per run, so it has to be a single line.
+	if strings.Count(output.String(), "\n") != 1 {
+		t.Errorf("writeJSON() wrote %q, want a single line", output.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(output.Bytes(), &got); err != nil {
+		t.Fatalf("summary is not JSON: %v", err)
+	}
+	want := map[string]any{
+		"links_found":     4.0,
+		"downloaded":      1.0,
+		"already_present": 1.0,
+		"skipped_other":   0.0,
+		"failed":          1.0,
+		"bytes":           1500.0,
+		"elapsed_seconds": 90.0,
+		"status_codes":    map[string]any{"200": 1.0, "404": 1.0},
+		"slowest": []any{
+			map[string]any{"url": "https://ipcol.com/a.pdf", "elapsed_seconds": 2.0},
+			map[string]any{"url": "https://ipcol.com/b.pdf", "elapsed_seconds": 1.0},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %v, want %v", got, want)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.json"), filepath.Join(dir, "new.json")
+	if err := download.WriteManifest(oldPath, []download.Record{
+		{URL: "https://ipcol.com/kept.pdf", SHA256: "aaa"},
+		{URL: "https://ipcol.com/revised.pdf", SHA256: "bbb"},
+		{URL: "https://ipcol.com/withdrawn.pdf", SHA256: "ccc"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.WriteManifest(newPath, []download.Record{
+		{URL: "https://ipcol.com/new.pdf", SHA256: "ddd"},
+		{URL: "https://ipcol.com/revised.pdf", SHA256: "eee"},
+		{URL: "https://ipcol.com/kept.pdf", SHA256: "aaa"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if err := runDiff(&output, oldPath, newPath); err != nil {
+		t.Fatalf("runDiff() error = %v", err)
+	}
+	want := `added (1):
+  + https://ipcol.com/new.pdf
+removed (1):
+  - https://ipcol.com/withdrawn.pdf
+changed (1):
+  ~ https://ipcol.com/revised.pdf (bbb → eee)
+`
+	if got := output.String(); got != want {
+		t.Errorf("diff output =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBatchStateResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFileName)
+	links := []string{"https://ipcol.com/a.pdf", "https://ipcol.com/b.pdf", "https://ipcol.com/c.pdf", "https://ipcol.com/d.pdf"}
+	state, pending, err := loadBatchState(path, links, false)
+	if err != nil || !slices.Equal(pending, links) {
+		t.Fatalf("loadBatchState() = %q, %v, want every link pending", pending, err)
+	}
+	// The run is interrupted after three links; d.pdf never started.
+	state.record(links[0], nil)
+	state.record(links[1], download.ErrAlreadyExists)
+	state.record(links[2], download.ErrSoft404)
+	if err := state.save(); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	_, pending, err = loadBatchState(path, append(links, "https://ipcol.com/e.pdf"), true)
+	if err != nil {
+		t.Fatalf("loadBatchState() with resume error = %v", err)
+	}
+	// Finished links are left out; the failed, pending and new ones remain.
+	want := []string{"https://ipcol.com/c.pdf", "https://ipcol.com/d.pdf", "https://ipcol.com/e.pdf"}
+	if !slices.Equal(pending, want) {
+		t.Errorf("pending after resume = %q, want %q", pending, want)
+	}
+}
+
+func TestResumedManifestKeepsFinishedLinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), download.ManifestFileName)
+	previous := []download.Record{
+		{URL: "https://ipcol.com/a.pdf", SHA256: "aaa"},
+		{URL: "https://ipcol.com/b.pdf", SHA256: "bbb"},
+		{URL: "https://ipcol.com/gone.pdf", SHA256: "ggg"},
+	}
+	if err := download.WriteManifest(path, previous); err != nil {
+		t.Fatal(err)
+	}
+	// a.pdf was finished before the interruption; b.pdf and c.pdf ran again.
+	links := []string{"https://ipcol.com/a.pdf", "https://ipcol.com/b.pdf", "https://ipcol.com/c.pdf"}
+	records := []download.Record{
+		{URL: "https://ipcol.com/b.pdf", SHA256: "bbb2"},
+		{URL: "https://ipcol.com/c.pdf", SHA256: "ccc"},
+	}
+
+	got, err := resumedManifest(path, records, links, links[1:])
+	if err != nil {
+		t.Fatalf("resumedManifest() error = %v", err)
+	}
+	var hashes []string
+	for _, record := range got {
+		hashes = append(hashes, record.SHA256)
+	}
+	if want := []string{"aaa", "bbb2", "ccc"}; !slices.Equal(hashes, want) {
+		t.Errorf("resumedManifest() hashes = %q, want %q", hashes, want)
+	}
+	// Without a previous manifest there is nothing to carry over.
+	if got, err := resumedManifest(path+".missing", records, links, links[1:]); err != nil || len(got) != len(records) {
+		t.Errorf("resumedManifest() without a manifest = %d records, %v, want %d records", len(got), err, len(records))
+	}
+}
+
+func TestCookieStoreKeepsSessionAcrossRequestsAndRuns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/listing" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/", HttpOnly: true})
+			return
+		}
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc" {
+			http.Error(w, "no session", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		io.WriteString(w, pdfBody)
+	}))
+	t.Cleanup(server.Close)
+	cookies := newCookieStore()
+	client := server.Client()
+	client.Jar = cookies
+	response, err := client.Get(server.URL + "/listing")
+	if err != nil {
+		t.Fatalf("fetch listing: %v", err)
+	}
+	response.Body.Close()
+	options := download.Options{Session: download.NewSession(download.HTTPOptions{Client: client, IgnoreRobots: true})}
+	for result := range download.Download(context.Background(), []string{server.URL + "/a.pdf"}, t.TempDir(), options) {
+		if result.Err != nil {
+			t.Fatalf("download with the session cookie: %v", result.Err)
+		}
+	}
+
+	// The next run picks the session up from the file.
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := cookies.save(path); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	loaded := newCookieStore()
+	if err := loaded.load(path); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	target, _ := url.Parse(server.URL + "/b.pdf")
+	got := loaded.Cookies(target)
+	if len(got) != 1 || got[0].Name != "session" || got[0].Value != "abc" {
+		t.Errorf("cookies after reload = %v, want session=abc", got)
+	}
+}
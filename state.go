@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Strong-Foundation/ipcol-com-documentation/download"
+	"github.com/Strong-Foundation/ipcol-com-documentation/internal/fsutil"
+)
+
+// stateFileName is the name of the checkpoint file in the output directory.
+const stateFileName = ".state.json"
+
+// checkpointInterval is the least time between two checkpoints written during a run.
+const checkpointInterval = 10 * time.Second
+
+// statePending marks a link that hasn't been processed yet. Processed links carry their
+// downloadOutcome: downloaded, skipped or failed.
+const statePending = "pending"
+
+// batchState tracks the status of every link in a batch and checkpoints it to a file, so an
+// interrupted batch can be resumed with -resume. It is safe for concurrent use.
+type batchState struct {
+	path      string
+	mutex     sync.Mutex
+	statuses  map[string]string // URL to statePending or a downloadOutcome
+	lastSaved time.Time
+}
+
+// loadBatchState returns the state for a batch of links checkpointed at path, and the links
+// still to be processed. With resume set and a checkpoint present, links that were downloaded
+// or skipped before are left out; failed and pending ones are tried again. Otherwise every
+// link starts out pending.
+func loadBatchState(path string, links []string, resume bool) (*batchState, []string, error) {
+	state := &batchState{path: path, statuses: make(map[string]string)}
+	if resume {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Nothing to resume from; start afresh.
+		case err != nil:
+			return nil, nil, fmt.Errorf("read state %s: %w", path, err)
+		default:
+			if err := json.Unmarshal(data, &state.statuses); err != nil {
+				return nil, nil, fmt.Errorf("read state %s: %w", path, err)
+			}
+		}
+	}
+	var remaining []string
+	for _, link := range links {
+		switch state.statuses[link] {
+		case "downloaded", "skipped":
+		default:
+			state.statuses[link] = statePending
+			remaining = append(remaining, link)
+		}
+	}
+	return state, remaining, nil
+}
+
+// record sets the status of uri from its outcome and checkpoints the state when the last
+// checkpoint is older than checkpointInterval. A nil state records nothing.
+func (state *batchState) record(uri string, err error) {
+	if state == nil {
+		return
+	}
+	state.mutex.Lock()
+	state.statuses[uri] = downloadOutcome(err)
+	due := time.Since(state.lastSaved) >= checkpointInterval
+	state.mutex.Unlock()
+	if due {
+		if err := state.save(); err != nil {
+			slog.Warn("unable to write checkpoint", "error", err)
+		}
+	}
+}
+
+// save writes the state to its file. A nil state has nothing to save.
+func (state *batchState) save() error {
+	if state == nil {
+		return nil
+	}
+	state.mutex.Lock()
+	data, err := json.MarshalIndent(state.statuses, "", "  ")
+	state.lastSaved = time.Now()
+	state.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := fsutil.WriteFileAtomic(state.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// resumedManifest returns the records of a resumed run together with what the manifest at
+// path says about the links of the batch that were finished before the interruption, so the
+// manifest keeps listing them. Links that were processed again, and links no longer in the
+// batch, keep only their new records. A missing manifest has nothing to carry over.
+func resumedManifest(path string, records []download.Record, links, pending []string) ([]download.Record, error) {
+	previous, err := readManifest(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return records, err
+	}
+	finished := make(map[string]bool)
+	for _, link := range links {
+		finished[link] = true
+	}
+	for _, link := range pending {
+		delete(finished, link)
+	}
+	var merged []download.Record
+	for _, record := range previous {
+		if finished[record.URL] {
+			merged = append(merged, record)
+		}
+	}
+	return append(merged, records...), nil
+}